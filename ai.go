@@ -0,0 +1,616 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+// A Backend is an AI service that can generate a reply to a conversation.  Each implementation
+// translates an AIRequest into its own wire format, calls its API, and translates the reply back
+// into an AIResponse, so the rest of the bot never needs to know which AI it is talking to.
+type Backend interface {
+    // Complete sends request to the AI and returns the AI's reply.
+    Complete(ctx context.Context, request *AIRequest) (*AIResponse, error)
+}
+
+// A StreamingBackend is a Backend that can also deliver the AI's reply incrementally as it is
+// generated.
+type StreamingBackend interface {
+    Backend
+
+    // CompleteStream sends request to the AI, calls onDelta with each piece of the reply as it
+    // arrives, and returns the complete reply when the AI is done.
+    CompleteStream(ctx context.Context, request *AIRequest, onDelta func(delta AIDelta)) (*AIResponse, error)
+}
+
+// An AIDelta is a piece of an AI reply delivered by a StreamingBackend.  Usually only one of its
+// fields is non-empty.
+type AIDelta struct {
+    // New reply text.
+    Text string
+
+    // New reasoning text.
+    Thinking string
+}
+
+// An AIRequest is a backend-neutral description of one query to the AI.
+type AIRequest struct {
+    // The model to use.  If this is empty, the backend's configured model is used.
+    Model string
+
+    // The system prompt.
+    System string
+
+    // The conversation history, oldest first, ending with the newest user message.
+    Messages []HistoryMessage
+
+    // The maximum number of tokens the AI will generate.
+    MaxTokens int
+
+    // If this is greater than zero, reasoning is enabled with this token budget.  Backends that
+    // don't support reasoning ignore this.
+    ThinkingBudget int
+
+    // If this is greater than zero, Web search is enabled and the AI can search this many times.
+    // Backends that don't support Web search ignore this.
+    MaxWebSearches int
+}
+
+// An AIResponse is a backend-neutral description of the AI's reply.
+type AIResponse struct {
+    // The text of the reply.
+    Text string
+
+    // The reasoning trace, if reasoning was enabled and the backend returns one.
+    Thinking string
+
+    // Why the AI stopped generating.  Backends translate their own values into the Messages API
+    // values "end_turn", "max_tokens", "stop_sequence", "tool_use", "pause_turn", and "refusal".
+    StopReason string
+
+    // The model that generated the reply, as reported by the API, or if the API doesn't say, the
+    // model the backend requested.
+    Model string
+
+    // The tokens consumed by the request.
+    Usage AIUsage
+
+    // The Web pages cited in the reply, in the order they were first cited, without duplicates.
+    // Backends that don't support Web search leave this empty.
+    Citations []AICitation
+}
+
+// An AICitation identifies a Web page that the AI cited in its reply.
+type AICitation struct {
+    URL   string
+    Title string
+}
+
+// This method adds citation to response.Citations, unless it has no URL or a citation with the
+// same URL is already there.
+func (response *AIResponse) addCitation(citation AICitation) {
+    if citation.URL == "" {
+        return
+    }
+
+    for _, existing := range response.Citations {
+        if existing.URL == citation.URL {
+            return
+        }
+    }
+
+    response.Citations = append(response.Citations, citation)
+}
+
+// An AIUsage holds the token counts reported by a backend for one request.  Counts that a backend
+// doesn't report are zero.
+type AIUsage struct {
+    InputTokens              int `json:"input_tokens"`
+    OutputTokens             int `json:"output_tokens"`
+    CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+    CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+    WebSearchRequests        int `json:"web_search_requests"`
+}
+
+// This function creates the Backend configured by cfg.  It returns an error if the backend name is
+// unknown or the backend cannot be configured (e.g., because its API key is not set).
+func newBackend(cfg *Config) (Backend, error) {
+    switch cfg.AI.Backend {
+    case "anthropic":
+        return newAnthropicBackend(cfg.AI.BaseURL, cfg.AI.Model, cfg.AI.RequestTimeout)
+
+    case "openai":
+        return newOpenAIBackend(cfg.AI.BaseURL, cfg.AI.Model, cfg.AI.RequestTimeout)
+
+    default:
+        return nil, fmt.Errorf("unknown AI backend '%v'", cfg.AI.Backend)
+    }
+}
+
+// A Query is a message from a Discord user that the bot answers with the AI's help.
+type Query struct {
+    // The name of the channel where the query was sent.  In a DM, this is the empty string.
+    ChannelName string
+
+    // The IDs of the server, channel, and message containing the query.  In a DM, GuildID is the
+    // empty string.  For a slash command, MessageID is the empty string.
+    GuildID   string
+    ChannelID string
+    MessageID string
+
+    // True if a thread can be started from the query's message (e.g., it's not in a DM or already
+    // in a thread).  See moveAnswerToThread.
+    ThreadAllowed bool
+
+    // The Discord user ID and nick of the user who sent the query, and the IDs of the user's roles
+    // in the server (none in a DM).
+    UserID  string
+    Nick    string
+    RoleIDs []string
+
+    // The key of the conversation that the query is part of (see conversationKey).
+    ConvKey string
+
+    // The text of the query.
+    Text string
+
+    // Quoted context that helps the AI understand Text (e.g., the message that Text is a reply
+    // to), or the empty string if there is none.  See getReplyContext.
+    QuotedContext string
+
+    // The files attached to the query's message, and the images and text files (formatted by
+    // formatDocument) among them that loadAttachments has downloaded.
+    Attachments []*discordgo.MessageAttachment
+    Images      []ContentBlock
+    Documents   []string
+}
+
+// This function returns the content of the user message that is sent to the AI for query: the
+// quoted context (if any) followed by the text of the query, then the query's text files, and then
+// its images.
+func (query *Query) userContent() []ContentBlock {
+    text := query.Text
+
+    if query.QuotedContext != "" {
+        text = query.QuotedContext + "\n\n" + text
+    }
+
+    var content []ContentBlock
+
+    if text != "" {
+        content = textContent(text)
+    }
+
+    for _, document := range query.Documents {
+        content = append(content, textContent(document)...)
+    }
+
+    return append(content, query.Images...)
+}
+
+// This function sends a message generated by the AI backend in response to query, using responder
+// to post it, unless it's long enough to be posted in a new thread instead (see
+// moveAnswerToThread).  If the query is allowed, it's queued with queryDispatcher to be answered by
+// answerQuery after the queries before it in the same conversation, and this function returns
+// without waiting for the answer.  The whole exchange uses the settings in cfg, even if the
+// configuration is reloaded while it is in progress.
+func sendAIGeneratedResponse(cfg *Config, session *discordgo.Session, responder Responder, query *Query) {
+    // Complain if the query is too long.  Quoted context doesn't count, because the user didn't
+    // write it.
+    maxUserMessageChars := cfg.Discord.MaxInputChars
+
+    if len(query.Text) > maxUserMessageChars {
+        msg := fmt.Sprintf("Sorry, I can't respond to messages that are longer than %v characters.",
+                           maxUserMessageChars)
+        responder.Send(msg)
+        return
+    }
+
+    if msg := checkQuotas(cfg, query); msg != "" {
+        // The user, channel, or server has used too many tokens.
+        responder.Send(msg)
+    } else if msg := checkRateLimits(cfg, query); msg != "" {
+        // The user, conversation, or bot has had too many queries too quickly.
+        responder.Send(msg)
+    } else {
+        // Answer the query once the queries before it in the conversation have been answered.  The
+        // user can cancel it until it has been answered.
+        ctx, done := trackQuery(query)
+
+        place, err := queryDispatcher.Submit(ctx, query.ConvKey, cfg.Dispatch.MaxWaiting,
+            func(ctx context.Context) {
+                defer done()
+                answerQuery(ctx, cfg, session, responder, query)
+            })
+
+        if err != nil {
+            // The query won't be answered, so it doesn't count against the rate limits.
+            done()
+            refundRateLimits(cfg, query)
+        }
+
+        if errors.Is(err, errShuttingDown) {
+            responder.Send("Sorry, I'm shutting down, so I can't answer that.")
+        } else if err != nil {
+            responder.Send(fmt.Sprintf("Sorry, %v %v already waiting for answers in this conversation. Please " +
+                                       "try again after I've answered %v.", cfg.Dispatch.MaxWaiting,
+                                       plural(cfg.Dispatch.MaxWaiting, "message is", "messages are"),
+                                       plural(cfg.Dispatch.MaxWaiting, "it", "them")))
+        } else if place > 0 {
+            responder.Send(fmt.Sprintf("You're #%v in line. I'll answer as soon as I've answered the " +
+                                       "messages before yours.", place))
+        }
+    }
+}
+
+// This function gets the AI's answer to query and posts it with responder, unless it's long enough
+// to be posted in a new thread instead.  It's run by queryDispatcher, which cancels ctx when the
+// bot shuts down or the user cancels the query (see trackQuery).  If answering the query takes
+// longer than the ai.request_timeout setting in cfg, the bot gives up.
+func answerQuery(ctx context.Context, cfg *Config, session *discordgo.Session, responder Responder, query *Query) {
+    if ctx.Err() != nil {
+        // The bot shut down, or the user canceled the query, while the query was waiting.  A user
+        // who canceled it doesn't need to be told.
+        if !errors.Is(context.Cause(ctx), errQueryCanceled) {
+            responder.Send("Sorry, I'm shutting down, so I can't answer that.")
+        }
+
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, cfg.AI.RequestTimeout)
+    defer cancel()
+
+    // Download the query's attachments, and tell the user about any that the AI won't see.
+    if skipped := loadAttachments(ctx, cfg, query); len(skipped) > 0 {
+        sendLongMessage(responder, strings.Join(skipped, "\n"))
+    }
+
+    if len(query.userContent()) == 0 {
+        // The query was only attachments, and all of them were skipped.
+        return
+    }
+
+    if _, ok := cfg.backend.(StreamingBackend); ok && cfg.AI.Streaming {
+        // Post a placeholder message and edit it as the response arrives from the AI.
+        streamer := newMessageStreamer(responder)
+
+        aiResponse := getAIResponse(ctx, cfg, query, streamer.update, streamer.notify)
+
+        // Replace the partial response with the complete response, or with a link to the thread
+        // holding the complete response.
+        if thread := moveAnswerToThread(cfg, session, query, aiResponse); thread != nil {
+            aiResponse = threadLinkMessage(thread)
+        }
+
+        streamer.finish(aiResponse)
+    } else {
+        // Generate a response from the AI.  If the request is retried, tell the user why they're
+        // waiting in a message that is replaced by the response.
+        var streamer *messageStreamer
+
+        aiResponse := getAIResponse(ctx, cfg, query, nil,
+            func(notice string) {
+                if streamer == nil {
+                    streamer = newMessageStreamer(responder)
+                }
+
+                streamer.notify(notice)
+            })
+
+        if thread := moveAnswerToThread(cfg, session, query, aiResponse); thread != nil {
+            aiResponse = threadLinkMessage(thread)
+        }
+
+        // Send the response text to the Discord server, split into as many messages as needed.
+        if streamer != nil {
+            streamer.finish(aiResponse)
+        } else {
+            sendLongMessage(responder, aiResponse)
+        }
+    }
+}
+
+// This function obtains an AI-generated response to query, which was received from Discord, using
+// the settings and backend in cfg.  If successful, it returns the AI-generated response, otherwise
+// it returns a string describing the nature of the error.  The request to the AI is canceled if ctx
+// is canceled.  If onProgress is not nil and the backend supports streaming, the response is
+// streamed from the AI and onProgress is called with the partial response (formatted the same as
+// the return value) each time more of it arrives.  If the AI's API is busy, the request is retried
+// as the ai.retry settings in cfg say, and onRetry (if it's not nil) is called with a notice for the
+// user before each retry.  The query and the response are added to the conversation history only
+// if the request succeeds, so a failed request can simply be repeated.
+func getAIResponse(ctx context.Context, cfg *Config, query *Query, onProgress func(partialResponse string),
+                   onRetry func(notice string)) string {
+    convKey := query.ConvKey
+
+    // The user message is saved in the conversation history along with the AI's response below.
+    userMessage := HistoryMessage{Role: "user", Content: query.userContent(), AuthorID: query.UserID,
+                                  AuthorName: query.Nick}
+
+    // Get the message history for this conversation, ending with the user message.
+    recentMessagesSlice, err := historyAsSlice(cfg, convKey, userMessage)
+
+    if err != nil {
+        msg := fmt.Sprintf("%v: getAIResponse: historyAsSlice failed: %v", Me, err)
+        fmt.Println(msg)
+        return msg
+    }
+
+    // Create the backend-neutral request.
+    request := &AIRequest{
+        System:    getSystemPrompt(cfg) + getSummaryPrompt(cfg, convKey),
+        Messages:  labelSpeakers(recentMessagesSlice),
+        MaxTokens: cfg.AI.MaxTokens,
+    }
+
+    if cfg.reasoningEnabled() {
+        // Here, the thinking budget must be smaller than MaxTokens above.
+        request.ThinkingBudget = cfg.AI.ThinkingBudget
+    }
+
+    if cfg.webSearchEnabled() {
+        request.MaxWebSearches = cfg.AI.MaxWebSearches
+    }
+
+    // Send the request to the AI, and send it again if the API is busy.
+    logRetry := func(err error, attempt int, delay time.Duration) {
+        fmt.Printf("%v: getAIResponse: %v (retrying in %v)\n", Me, err, delay.Round(time.Millisecond))
+
+        if onRetry != nil {
+            onRetry(retryNotice(err, attempt, cfg.AI.Retry.MaxAttempts, delay))
+        }
+    }
+
+    response, err := withRetries(ctx, cfg, logRetry, func() (*AIResponse, error) {
+        streamingBackend, ok := cfg.backend.(StreamingBackend)
+
+        if !ok || onProgress == nil {
+            return cfg.backend.Complete(ctx, request)
+        }
+
+        var partialText, partialThinking string
+
+        response, err := streamingBackend.CompleteStream(ctx, request,
+            func(delta AIDelta) {
+                partialText += delta.Text
+                partialThinking += delta.Thinking
+                onProgress(formatAIResponse(cfg, partialThinking, partialText))
+            })
+
+        if err != nil && (partialText != "" || partialThinking != "") {
+            // Part of the response was already shown, and a retry would get a different one.
+            err = finalError{err}
+        }
+
+        return response, err
+    })
+
+    if err != nil {
+        msg := fmt.Sprintf("%v: getAIResponse: %v", Me, err)
+        fmt.Println(msg)
+
+        if ctx.Err() != nil {
+            // The request was canceled or timed out, which the user understands without details.
+            return canceledQueryMessage(cfg, ctx)
+        }
+
+        return msg
+    }
+
+    // Record the tokens used.
+    recordUsage(cfg, query, convKey, response)
+
+    // Update the conversation history to have the user message and the AI's response.  The
+    // history names the user's images rather than holding their data.
+    assistantText := strings.TrimSpace(response.Thinking + "\n\n" + response.Text)
+
+    assistantMessage := HistoryMessage{Role: "assistant", Content: textContent(assistantText)}
+
+    historySaveExchange(cfg, userMessage.withImagePlaceholders(), assistantMessage, convKey)
+
+    // Return the AI-generated response, followed by the sources it cites.  The sources aren't
+    // saved in the history, because the AI doesn't need to see them again.
+    formattedResponse := formatAIResponse(cfg, response.Thinking, response.Text)
+
+    if cfg.AI.ShowSources && len(response.Citations) > 0 {
+        formattedResponse += "\n\n" + formatSources(response.Citations)
+    }
+
+    return formattedResponse
+}
+
+// This function formats the AI's reasoning trace and reply text for display in Discord, as
+// configured by cfg.  An empty reasoning trace (e.g., from a backend that doesn't support reasoning)
+// isn't shown.
+func formatAIResponse(cfg *Config, thinkingText string, aiText string) string {
+    if cfg.AI.Reasoning && thinkingText != "" {
+        return "**<thinking>**" + thinkingText + "\n**</thinking>**\n\n" + aiText
+    } else {
+        return aiText
+    }
+}
+
+// The maximum number of characters in the title of a source listed after the AI's reply.
+const SOURCE_TITLE_MAX_CHARS = 80
+
+// This function formats citations as a numbered list of sources to follow the AI's reply.  Each URL
+// is wrapped in angle brackets, so that Discord doesn't show a preview of every page.  Long titles
+// are shortened.
+func formatSources(citations []AICitation) string {
+    var sources strings.Builder
+
+    sources.WriteString("**Sources:**")
+
+    for index, citation := range citations {
+        title := strings.TrimSpace(citation.Title)
+
+        if runes := []rune(title); len(runes) > SOURCE_TITLE_MAX_CHARS {
+            title = strings.TrimSpace(string(runes[:SOURCE_TITLE_MAX_CHARS-3])) + "..."
+        }
+
+        if title == "" {
+            sources.WriteString(fmt.Sprintf("\n%v. <%v>", index+1, citation.URL))
+        } else {
+            sources.WriteString(fmt.Sprintf("\n%v. %v: <%v>", index+1, title, citation.URL))
+        }
+    }
+
+    return sources.String()
+}
+
+// This function returns the system prompt to be sent in each request to the AI, which is the
+// system prompt configured in cfg plus today's date and a description of the Discord setting.
+func getSystemPrompt(cfg *Config) string {
+    todaysDate := time.Now().Format(time.DateOnly)
+
+    var webSearchPrompt string
+
+    if cfg.webSearchEnabled() {
+        webSearchPrompt = " Only use the Web search tool when you do not have the necessary " +
+                          "knowledge to respond."
+    }
+
+    var replyContextPrompt string
+
+    if cfg.Discord.ReplyContextDepth > 0 || cfg.Discord.Threads.SeedFromStarter {
+        replyContextPrompt = " Some user messages start with quoted context: lines starting with " +
+                             "'> ' that quote other Discord messages (e.g., the message being replied " +
+                             "to), which are not part of the user's own message."
+    }
+
+    return fmt.Sprintf("Today's date is %s. ", todaysDate) +
+           cfg.AI.SystemPrompt +
+           webSearchPrompt +
+           " You are connected to a Discord server, where several people may be talking to " +
+           "you in the same conversation. Each user message starts with a label that " +
+           "gives the speaker's display name and Discord mention, like this: " +
+           "'[Alice (<@123456>)]: '. Keep track of who said what, and address people by " +
+           "name. To notify someone, include their mention exactly as it appears in the " +
+           "label. Do not start your replies with a label." +
+           replyContextPrompt +
+           " Your output must use Discord markdown so that it renders correctly."
+}
+
+// This function returns a copy of messages in which each user message starts with a label that
+// identifies the speaker (see speakerLabel), so that the AI can tell people apart.  The label is
+// added to the message's first text block, or in a new text block if the first block isn't text.
+func labelSpeakers(messages []HistoryMessage) []HistoryMessage {
+    labeledMessages := make([]HistoryMessage, len(messages))
+
+    for index, message := range messages {
+        label := speakerLabel(message)
+
+        if label != "" {
+            // Copy the content, because it is shared with the conversation history.
+            content := make([]ContentBlock, 0, len(message.Content)+1)
+
+            if len(message.Content) > 0 && message.Content[0].Type == "text" {
+                content = append(content, ContentBlock{Type: "text", Text: label + message.Content[0].Text})
+                content = append(content, message.Content[1:]...)
+            } else {
+                content = append(content, ContentBlock{Type: "text", Text: label})
+                content = append(content, message.Content...)
+            }
+
+            message.Content = content
+        }
+
+        labeledMessages[index] = message
+    }
+
+    return labeledMessages
+}
+
+// Replaces the characters in a display name that could end a speaker label early or fake the
+// start of another one.
+var speakerNameReplacer = strings.NewReplacer("[", "(", "]", ")", "\r\n", " ", "\n", " ", "\r", " ")
+
+// This function returns the label that identifies the speaker of message to the AI (e.g.,
+// "[Alice (<@123456>)]: "), or the empty string if message is not a user message or its speaker
+// is unknown.  Brackets and line breaks in the speaker's name are replaced, so that nobody can
+// pose as someone else by choosing a name like "Bob]: hi\n[Alice".
+func speakerLabel(message HistoryMessage) string {
+    if message.Role != "user" || message.AuthorID == "" {
+        return ""
+    }
+
+    return fmt.Sprintf("[%s (<@%s>)]: ", speakerNameReplacer.Replace(message.AuthorName), message.AuthorID)
+}
+
+// This function reads the body of the HTTP response and returns the JSON as a byte slice, the
+// number of bytes read, and an error if any.  If no error occurs, the string returned is "".
+func getJSONFromHTTPResponse(httpResponse *http.Response) ([]byte, int, string) {
+    // Get the 'Content-Length' header so we know how big to make the byte slice that will hold
+    // the response body.
+    contentLength := httpResponse.ContentLength
+
+    // For debugging.
+    // fmt.Printf("contentLength = %v\n", contentLength)
+
+    if contentLength <= 0 {
+        // Sometimes the Content-Length header is -1, so we have to wing it.  Hopefully, 1 MB is
+        // enough space.
+        contentLength = 1024 * 1024
+    }
+
+    // Get the text of the body of the response, which contains JSON.
+    jsonBytes := make([]byte, contentLength)
+    jsonBytesCount := 0
+
+    // Each call to httpResponse.Body.Read will fill some (or all) of this sub-slice of jsonBytes
+    // with the next group of bytes, then if necessary the start of this sub-slice will be advanced
+    // along slice jsonBytes to be ready for the next call to Read.
+    jsonBytesForReading := jsonBytes[:contentLength]
+
+    // Read the entire response body by calling httpResponse.Body.Read() in a loop until err != nil.
+    for {
+        bytesRead, err := httpResponse.Body.Read(jsonBytesForReading)
+
+        // For debugging.
+        // if bytesRead == 0 && err.Error() != "EOF" {
+        //     fmt.Printf("WARNING: bytesRead == 0: err == %v\n", err)
+        // }
+
+        // Increment the accumulated number of  bytes we just read.
+        jsonBytesCount += bytesRead
+
+        // For debugging.
+        // fmt.Printf("bytesRead = %v, jsonBytesCount = %v\n", bytesRead, jsonBytesCount)
+
+        if err != nil {
+            // If we get an EOF error reading the body, break out of the loop.  This is the normal
+            // indication that we have read the entire response body.
+            if err.Error() == "EOF" {
+                break
+            }
+
+            // All other errors are unexpected.
+            msg := fmt.Sprintf("Error: Error reading AI response body: %s", err)
+            fmt.Println(msg)
+            return nil, 0, msg
+        }
+
+        if int64(bytesRead) >= (contentLength - 100) {
+            // We're out of space to hold the rest of the response, which means the JSON in the
+            // response won't un-marshal correctly.
+            msg := fmt.Sprintf("Error: AI response too large to process: bytesRead = %v", bytesRead)
+            fmt.Println(msg)
+            return nil, 0, msg
+        }
+
+        // Advance slice jsonBytesForReading to one byte past the bytes read so far.
+        jsonBytesForReading = jsonBytes[jsonBytesCount:]
+    }
+
+    // For debugging.
+    // fmt.Printf("Got %v bytes of JSON.\n", jsonBytesCount)
+
+    return jsonBytes, jsonBytesCount, ""
+}
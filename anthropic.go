@@ -0,0 +1,461 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+// The default base URL and model used by the Anthropic backend.
+const (
+    DEFAULT_ANTHROPIC_BASE_URL = "https://api.anthropic.com"
+    DEFAULT_ANTHROPIC_MODEL    = "claude-sonnet-4-20250514"
+)
+
+// AnthropicBackend is a Backend that uses Anthropic's Messages API.  See
+// https://docs.anthropic.com/en/api/overview for details about the Claude API.
+type AnthropicBackend struct {
+    // The API endpoint URL.
+    URL string
+
+    // The API key sent in the 'x-api-key' header.
+    APIKey string
+
+    // The model used when an AIRequest doesn't specify one.
+    Model string
+
+    // The HTTP client used to send requests.
+    Client *http.Client
+}
+
+// This function creates an AnthropicBackend that uses the API at baseURL and the given model.  If
+// either is the empty string, the default is used.  HTTP requests that take longer than timeout
+// (including reading the response) fail.  The API key is taken from environment variable
+// ANTHROPIC_API_KEY.
+func newAnthropicBackend(baseURL string, model string, timeout time.Duration) (*AnthropicBackend, error) {
+    apiKey := os.Getenv("ANTHROPIC_API_KEY")
+
+    if apiKey == "" {
+        return nil, fmt.Errorf("environment variable ANTHROPIC_API_KEY not set")
+    }
+
+    if model == "" {
+        // TODO: Switch to "claude-sonnet-4-0", which is an alias for the latest Sonnet 4 version.
+        model = DEFAULT_ANTHROPIC_MODEL
+    }
+
+    if baseURL == "" {
+        baseURL = DEFAULT_ANTHROPIC_BASE_URL
+    }
+
+    return &AnthropicBackend{
+        URL:    strings.TrimSuffix(baseURL, "/") + "/v1/messages",
+        APIKey: apiKey,
+        Model:  model,
+        Client: &http.Client{Timeout: timeout},
+    }, nil
+}
+
+// Complete sends request to the Messages API and returns the AI's reply.
+func (backend *AnthropicBackend) Complete(ctx context.Context, request *AIRequest) (*AIResponse, error) {
+    jsonObject := backend.buildRequestJSON(request)
+    httpResponse, err := backend.post(ctx, jsonObject)
+
+    if err != nil {
+        return nil, err
+    }
+
+    // Close the HTTP connection at this function's return.
+    defer httpResponse.Body.Close()
+
+    // Parse the HTTP response from the AI.
+    aiResponse, err := parseAIResponse(httpResponse)
+
+    if err == nil && aiResponse.Model == "" {
+        // The API didn't say which model answered, so it's the one requested.
+        aiResponse.Model = jsonObject["model"].(string)
+    }
+
+    return aiResponse, err
+}
+
+// CompleteStream sends request to the Messages API in streaming mode.  It calls onDelta with each
+// piece of text or reasoning as it arrives, then returns the complete reply once the stream ends.
+func (backend *AnthropicBackend) CompleteStream(ctx context.Context, request *AIRequest,
+                                                onDelta func(delta AIDelta)) (*AIResponse, error) {
+    jsonObject := backend.buildRequestJSON(request)
+    jsonObject["stream"] = true
+
+    httpResponse, err := backend.post(ctx, jsonObject)
+
+    if err != nil {
+        return nil, err
+    }
+
+    // Close the HTTP connection at this function's return.
+    defer httpResponse.Body.Close()
+
+    aiResponse, err := parseAIResponseStream(httpResponse, onDelta)
+
+    if err == nil && aiResponse.Model == "" {
+        // The API didn't say which model answered, so it's the one requested.
+        aiResponse.Model = jsonObject["model"].(string)
+    }
+
+    return aiResponse, err
+}
+
+// This function marshals jsonObject, POSTs it to the Messages API, and returns the HTTP response.
+// The caller must close the response body.  An HTTP status other than 200 is returned as an error.
+func (backend *AnthropicBackend) post(ctx context.Context, jsonObject map[string]any) (*http.Response, error) {
+    requestBody, err := json.Marshal(jsonObject)
+
+    if err != nil {
+        return nil, fmt.Errorf("json.Marshal failed: %v", err)
+    }
+
+    // For debugging.
+    // fmt.Println("Request JSON =", string(requestBody))
+
+    // Create the HTTP request from the above requestBody.
+    req, err := http.NewRequestWithContext(ctx, "POST", backend.URL, bytes.NewBuffer(requestBody))
+
+    if err != nil {
+        return nil, fmt.Errorf("Error creating HTTP request: %v", err)
+    }
+
+    // Set some required HTTP headers.
+    req.Header.Set("x-api-key", backend.APIKey)
+    req.Header.Set("anthropic-version", "2023-06-01")
+    req.Header.Set("Content-Type", "application/json")
+
+    // Send the HTTP request to the AI and get the HTTP response.  The body of the response is JSON
+    // (or a stream of server-sent events) containing the AI's response to the user's message.
+    httpResponse, err := backend.Client.Do(req)
+
+    if err != nil {
+        return nil, fmt.Errorf("Network communication error: %w", err)
+    }
+
+    // Handle HTTP errors.
+    if httpResponse.StatusCode != http.StatusOK {
+        defer httpResponse.Body.Close()
+        return nil, newAPIError(httpResponse)
+    }
+
+    return httpResponse, nil
+}
+
+// This function converts request into the JSON object expected by the Messages API.  The returned
+// map will be passed to json.Marshal to convert it into JSON.
+func (backend *AnthropicBackend) buildRequestJSON(request *AIRequest) map[string]any {
+    jsonObject := make(map[string]any)
+
+    jsonObject["model"] = backend.Model
+
+    if request.Model != "" {
+        jsonObject["model"] = request.Model
+    }
+
+    jsonObject["max_tokens"] = request.MaxTokens  // The maximum number of tokens the AI will generate.
+    jsonObject["system"] = request.System
+    jsonObject["messages"] = anthropicMessages(request.Messages)
+
+    if request.ThinkingBudget > 0 {
+        // Here, 'budget_tokens' must be smaller than 'max_tokens' above.
+        jsonObject["thinking"] = map[string]any{ "type": "enabled", "budget_tokens": request.ThinkingBudget }
+    }
+
+    if request.MaxWebSearches > 0 {
+        jsonObject["tools"] = []map[string]any{{"type": "web_search_20250305",
+                                                "name": "web_search",
+                                                "max_uses": request.MaxWebSearches }}
+    }
+
+    return jsonObject
+}
+
+// This function converts messages into the 'messages' array of a Messages API request.  Text
+// blocks become 'text' content blocks, and image blocks become 'image' content blocks with base64
+// sources.  The API rejects empty text blocks, so they are dropped.
+func anthropicMessages(messages []HistoryMessage) []map[string]any {
+    jsonMessages := make([]map[string]any, 0, len(messages))
+
+    for _, message := range messages {
+        content := make([]map[string]any, 0, len(message.Content))
+
+        for _, block := range message.Content {
+            switch block.Type {
+            case "text":
+                if block.Text != "" {
+                    content = append(content, map[string]any{"type": "text", "text": block.Text})
+                }
+
+            case "image":
+                content = append(content, map[string]any{
+                    "type":   "image",
+                    "source": map[string]any{"type": "base64", "media_type": block.MediaType, "data": block.Data},
+                })
+            }
+        }
+
+        jsonMessages = append(jsonMessages, map[string]any{"role": message.Role, "content": content})
+    }
+
+    return jsonMessages
+}
+
+// This function processes the HTTP response from the Messages API and returns the AI's reply.
+func parseAIResponse(httpResponse *http.Response) (*AIResponse, error) {
+    jsonBytes, jsonBytesCount, msg := getJSONFromHTTPResponse(httpResponse)
+
+    if msg != "" {
+        return nil, fmt.Errorf("%s", msg)
+    }
+
+    // This holds the unmarshaled JSON response from the AI.
+    var response map[string]any
+
+    // Unmarshal the JSON into object 'response'.  Must use jsonBytes[:jsonBytesCount] to avoid reading
+    // beyond the end of the valid data in slice jsonBytes.
+    err := json.Unmarshal(jsonBytes[:jsonBytesCount], &response)
+
+    if err != nil {
+        return nil, fmt.Errorf("Error unmarshalling AI response: %s", err)
+    }
+
+    // Check if the response contains a 'content' key.
+    contentSlice, ok := response["content"].([]any)
+
+    if !ok || len(contentSlice) == 0 {
+        return nil, fmt.Errorf("Failed to find expected JSON (#0).")
+    }
+
+    // This will hold the AI's reply.
+    aiResponse := &AIResponse{}
+
+    if stopReason, ok := response["stop_reason"].(string); ok {
+        aiResponse.StopReason = stopReason
+    }
+
+    if model, ok := response["model"].(string); ok {
+        aiResponse.Model = model
+    }
+
+    // Get the token counts from the 'usage' object.
+    if usage, ok := response["usage"].(map[string]any); ok {
+        aiResponse.Usage = parseAnthropicUsage(usage)
+    }
+
+    // TODO: Refactor this for loop into a new function.
+
+    // Iterate over all elements of contentSlice and concatenate the text.  contentSlice is a slice
+    // of maps.  This loop extracts the text from each element of contentSlice that has a "type" key
+    // with value "text", concatenates the text, and returns the concatenated text.  Text elements
+    // that use Web search results also have a "citations" key, whose value lists the sources.  All
+    // other "type" values are ignored (e.g., "server_tool_use" and "web_search_tool_result"), but
+    // when reasoning is enabled, this also handles "type" value "thinking", which comes with
+    // key "thinking" whose value is the reasoning trace.
+
+    for index := 0; index < len(contentSlice); index++ {
+        // Get the map from contentSlice[index].
+        contentElement, ok := contentSlice[index].(map[string]any)
+
+        if !ok {
+            return nil, fmt.Errorf("Failed to find expected JSON (#1).")
+        }
+
+        // Ignore all content types except "text" and "thinking".
+
+        if contentElement["type"] == "text" {
+            // Extract the text value associated with key "text".
+            elementText, ok := contentElement["text"].(string)
+
+            if !ok {
+                return nil, fmt.Errorf("Failed to find expected JSON (#2).")
+            }
+
+            aiResponse.Text += elementText
+
+            if citations, ok := contentElement["citations"].([]any); ok {
+                for _, citation := range citations {
+                    if citationObject, ok := citation.(map[string]any); ok {
+                        aiResponse.addCitation(parseAnthropicCitation(citationObject))
+                    }
+                }
+            }
+        }
+
+        if contentElement["type"] == "thinking" {
+            // Extract the text value associated with key "thinking".
+            elementText, ok := contentElement["thinking"].(string)
+
+            if !ok {
+                return nil, fmt.Errorf("Failed to find expected JSON (#3).")
+            }
+
+            // Append the thinking text to the AI response.
+            aiResponse.Thinking += elementText
+        }
+    }
+
+    return aiResponse, nil
+}
+
+// This function converts the 'usage' object of a Messages API response into an AIUsage.
+func parseAnthropicUsage(usage map[string]any) AIUsage {
+    // JSON numbers are unmarshaled as float64.
+    count := func(object map[string]any, key string) int {
+        value, _ := object[key].(float64)
+        return int(value)
+    }
+
+    aiUsage := AIUsage{
+        InputTokens:              count(usage, "input_tokens"),
+        OutputTokens:             count(usage, "output_tokens"),
+        CacheCreationInputTokens: count(usage, "cache_creation_input_tokens"),
+        CacheReadInputTokens:     count(usage, "cache_read_input_tokens"),
+    }
+
+    if serverToolUse, ok := usage["server_tool_use"].(map[string]any); ok {
+        aiUsage.WebSearchRequests = count(serverToolUse, "web_search_requests")
+    }
+
+    return aiUsage
+}
+
+// This function converts one element of the 'citations' array of a Messages API text block into an
+// AICitation.  Only Web search citations have a URL.  For other citations, the URL is empty.
+func parseAnthropicCitation(citation map[string]any) AICitation {
+    url, _ := citation["url"].(string)
+    title, _ := citation["title"].(string)
+
+    return AICitation{URL: url, Title: title}
+}
+
+// This type describes the JSON in the 'data' field of one server-sent event in a streaming Messages
+// API response.  Only the fields the bot uses are present.  See
+// https://docs.anthropic.com/en/docs/build-with-claude/streaming for details.
+type anthropicStreamEvent struct {
+    Type string `json:"type"`
+
+    // Present in "message_start" events.
+    Message struct {
+        Model string         `json:"model"`
+        Usage map[string]any `json:"usage"`
+    } `json:"message"`
+
+    // Present in "content_block_delta" and "message_delta" events.
+    Delta struct {
+        Type       string `json:"type"`
+        Text       string `json:"text"`
+        Thinking   string `json:"thinking"`
+        StopReason string `json:"stop_reason"`
+
+        // Present in "citations_delta" deltas.
+        Citation map[string]any `json:"citation"`
+    } `json:"delta"`
+
+    // Present in "message_delta" events.
+    Usage map[string]any `json:"usage"`
+
+    // Present in "error" events.
+    Error struct {
+        Type    string `json:"type"`
+        Message string `json:"message"`
+    } `json:"error"`
+}
+
+// This function reads a streaming Messages API response one server-sent event at a time, calling
+// onDelta for each text or reasoning delta, and returns the complete reply when the "message_stop"
+// event arrives.
+func parseAIResponseStream(httpResponse *http.Response, onDelta func(delta AIDelta)) (*AIResponse, error) {
+    aiResponse := &AIResponse{}
+
+    // Events that carry Web search results can be much larger than bufio.Scanner's default
+    // maximum line length.
+    scanner := bufio.NewScanner(httpResponse.Body)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+    for scanner.Scan() {
+        // Each event is an 'event: TYPE' line followed by a 'data: JSON' line and a blank line.  The
+        // event type is repeated in the JSON, so only the 'data' lines matter.
+        line := scanner.Text()
+
+        if !strings.HasPrefix(line, "data:") {
+            continue
+        }
+
+        var event anthropicStreamEvent
+
+        err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event)
+
+        if err != nil {
+            return nil, fmt.Errorf("Error unmarshalling AI stream event: %s", err)
+        }
+
+        switch event.Type {
+        case "message_start":
+            aiResponse.Model = event.Message.Model
+            aiResponse.Usage = parseAnthropicUsage(event.Message.Usage)
+
+        case "content_block_delta":
+            switch event.Delta.Type {
+            case "text_delta":
+                aiResponse.Text += event.Delta.Text
+                onDelta(AIDelta{Text: event.Delta.Text})
+
+            case "thinking_delta":
+                aiResponse.Thinking += event.Delta.Thinking
+                onDelta(AIDelta{Thinking: event.Delta.Thinking})
+
+            case "citations_delta":
+                aiResponse.addCitation(parseAnthropicCitation(event.Delta.Citation))
+            }
+
+        case "message_delta":
+            aiResponse.StopReason = event.Delta.StopReason
+
+            // The counts in a "message_delta" event are cumulative, so they replace the counts
+            // from the "message_start" event.  The input counts only appear when they changed
+            // (e.g., because Web search results were added to the input), so a missing or zero
+            // count keeps the earlier one.
+            usage := parseAnthropicUsage(event.Usage)
+            aiResponse.Usage.OutputTokens = usage.OutputTokens
+
+            if usage.InputTokens > 0 {
+                aiResponse.Usage.InputTokens = usage.InputTokens
+            }
+
+            if usage.CacheCreationInputTokens > 0 {
+                aiResponse.Usage.CacheCreationInputTokens = usage.CacheCreationInputTokens
+            }
+
+            if usage.CacheReadInputTokens > 0 {
+                aiResponse.Usage.CacheReadInputTokens = usage.CacheReadInputTokens
+            }
+
+            if usage.WebSearchRequests > 0 {
+                aiResponse.Usage.WebSearchRequests = usage.WebSearchRequests
+            }
+
+        case "message_stop":
+            return aiResponse, nil
+
+        case "error":
+            return nil, anthropicStreamError(event.Error.Type, event.Error.Message)
+        }
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("Error reading AI response stream: %w", err)
+    }
+
+    return nil, fmt.Errorf("AI response stream ended before message_stop")
+}
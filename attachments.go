@@ -0,0 +1,266 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "net/http"
+    "path/filepath"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+const (
+    // A rough estimate of the number of tokens in an image sent to the AI.  The Messages API scales
+    // large images down to about 1.15 megapixels, which costs about 1600 tokens.
+    IMAGE_TOKENS = 1600
+
+    // The image types the AI can see.
+    SUPPORTED_IMAGE_TYPES = "PNG, JPEG, GIF, or WebP"
+)
+
+var (
+    // The HTTP client used to download attachments from Discord.
+    attachmentClient = &http.Client{Timeout: 30 * time.Second}
+
+    // The extensions of files that are read as text.  Discord often doesn't know that source code
+    // is text.
+    textFileExtensions = map[string]bool{
+        ".txt": true, ".log": true, ".md": true, ".csv": true, ".json": true, ".yaml": true, ".yml": true,
+        ".toml": true, ".ini": true, ".cfg": true, ".conf": true, ".xml": true, ".html": true, ".css": true,
+        ".go": true, ".py": true, ".js": true, ".ts": true, ".java": true, ".c": true, ".h": true,
+        ".cpp": true, ".hpp": true, ".cs": true, ".rs": true, ".rb": true, ".php": true, ".sh": true,
+        ".ps1": true, ".bat": true, ".sql": true, ".diff": true, ".patch": true,
+    }
+
+    // The media types, other than "text/...", of files that are read as text.
+    textMediaTypes = map[string]bool{
+        "application/json": true, "application/xml": true, "application/x-yaml": true,
+        "application/toml": true, "application/x-sh": true, "application/sql": true,
+    }
+)
+
+// This function downloads the attachments of query that the AI can use, as allowed by the
+// attachments settings in cfg, and adds them to query: images to query.Images, and text files to
+// query.Documents.  It returns a message for each attachment that was skipped, explaining why.  The
+// downloads are canceled if ctx is canceled.
+func loadAttachments(ctx context.Context, cfg *Config, query *Query) []string {
+    var skipped []string
+
+    for _, attachment := range query.Attachments {
+        var reason string
+
+        switch {
+        case isImageAttachment(attachment):
+            reason = loadImageAttachment(ctx, cfg, query, attachment)
+        case isTextAttachment(attachment):
+            reason = loadTextAttachment(ctx, cfg, query, attachment)
+        default:
+            reason = "I can only read text files and " + SUPPORTED_IMAGE_TYPES + " images."
+        }
+
+        if reason != "" {
+            skipped = append(skipped, fmt.Sprintf("I ignored the attachment '%v' because %v", attachment.Filename,
+                                                  reason))
+        }
+    }
+
+    return skipped
+}
+
+// This function downloads attachment, which is an image, and adds it to query.Images.  If the
+// attachments settings in cfg don't allow that, or it fails, it returns the reason, otherwise it
+// returns the empty string.
+func loadImageAttachment(ctx context.Context, cfg *Config, query *Query,
+                         attachment *discordgo.MessageAttachment) string {
+    if !cfg.Attachments.Images {
+        return "I'm not allowed to look at images."
+    }
+
+    if len(query.Images) >= cfg.Attachments.MaxImages {
+        return fmt.Sprintf("I can only look at %v images per message.", cfg.Attachments.MaxImages)
+    }
+
+    if attachment.Size > cfg.Attachments.MaxImageBytes {
+        return fmt.Sprintf("it's larger than %v.", formatByteCount(cfg.Attachments.MaxImageBytes))
+    }
+
+    // The image must fit in the conversation history along with the query and the other
+    // attachments, like a text file.
+    if attachmentTokens(query)+IMAGE_TOKENS > queryAttachmentBudget(cfg, query) {
+        return "I don't have room to look at it along with the rest of your message."
+    }
+
+    imageBytes, err := downloadAttachment(ctx, attachment, cfg.Attachments.MaxImageBytes)
+
+    if err != nil {
+        fmt.Printf("%v: loadImageAttachment: Error downloading '%v': %v\n", Me, attachment.Filename, err)
+        return "I couldn't download it."
+    }
+
+    // Trust the image data rather than the file name or the type Discord reports.
+    mediaType := http.DetectContentType(imageBytes)
+
+    switch mediaType {
+    case "image/png", "image/jpeg", "image/gif", "image/webp":
+        query.Images = append(query.Images, ContentBlock{
+            Type:      "image",
+            MediaType: mediaType,
+            Data:      base64.StdEncoding.EncodeToString(imageBytes),
+            Name:      attachment.Filename,
+        })
+
+        return ""
+
+    default:
+        return fmt.Sprintf("it isn't a %v image.", SUPPORTED_IMAGE_TYPES)
+    }
+}
+
+// This function downloads attachment, which is a text file, and adds it to query.Documents as a
+// fenced code block labeled with the file's name.  If the attachments settings in cfg don't allow
+// that, or it fails, it returns the reason, otherwise it returns the empty string.
+func loadTextAttachment(ctx context.Context, cfg *Config, query *Query,
+                        attachment *discordgo.MessageAttachment) string {
+    if !cfg.Attachments.TextFiles {
+        return "I'm not allowed to read files."
+    }
+
+    if len(query.Documents) >= cfg.Attachments.MaxTextFiles {
+        return fmt.Sprintf("I can only read %v files per message.", cfg.Attachments.MaxTextFiles)
+    }
+
+    if attachment.Size > cfg.Attachments.MaxTextBytes {
+        return fmt.Sprintf("it's larger than %v.", formatByteCount(cfg.Attachments.MaxTextBytes))
+    }
+
+    textBytes, err := downloadAttachment(ctx, attachment, cfg.Attachments.MaxTextBytes)
+
+    if err != nil {
+        fmt.Printf("%v: loadTextAttachment: Error downloading '%v': %v\n", Me, attachment.Filename, err)
+        return "I couldn't download it."
+    }
+
+    if !utf8.Valid(textBytes) || bytes.IndexByte(textBytes, 0) >= 0 {
+        return "it isn't a text file."
+    }
+
+    document := formatDocument(attachment.Filename, string(textBytes))
+
+    // The whole document must fit in the conversation history along with the query and the other
+    // attachments, or the AI can't read it.
+    if attachmentTokens(query)+estimateTokens(document) > queryAttachmentBudget(cfg, query) {
+        return "it's too long for me to read in one go."
+    }
+
+    query.Documents = append(query.Documents, document)
+    return ""
+}
+
+// This function returns a rough estimate of the number of tokens in the images and text files
+// that have been added to query.
+func attachmentTokens(query *Query) int {
+    tokens := len(query.Images) * IMAGE_TOKENS
+
+    for _, document := range query.Documents {
+        tokens += estimateTokens(document)
+    }
+
+    return tokens
+}
+
+// This function returns the number of tokens available for the attachments of query, which is
+// whatever the query's text leaves of the history token budget of cfg (see historyTokenBudget).
+func queryAttachmentBudget(cfg *Config, query *Query) int {
+    return historyTokenBudget(cfg) - estimateTokens(query.QuotedContext+query.Text)
+}
+
+// This function returns the text of the file named fileName formatted for the AI: a line giving
+// the file's name, followed by the text in a code block.  The code block's language is taken from
+// the file's extension, and its fence is longer than any run of backticks in text, so that text
+// can't end the code block early.
+func formatDocument(fileName string, text string) string {
+    fence := CODE_FENCE
+
+    for strings.Contains(text, fence) {
+        fence += "`"
+    }
+
+    language := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+
+    if language == "txt" || language == "log" {
+        language = ""
+    }
+
+    return fmt.Sprintf("[Attached file: %v]\n%v%v\n%v\n%v", fileName, fence, language,
+                       strings.TrimRight(text, "\n"), fence)
+}
+
+// This function returns true if attachment appears to be an image, based on the content type
+// that Discord reports for it.
+func isImageAttachment(attachment *discordgo.MessageAttachment) bool {
+    return strings.HasPrefix(attachment.ContentType, "image/")
+}
+
+// This function returns true if attachment appears to be a text file, based on its extension or
+// the content type that Discord reports for it.
+func isTextAttachment(attachment *discordgo.MessageAttachment) bool {
+    mediaType, _, _ := strings.Cut(attachment.ContentType, ";")
+
+    return strings.HasPrefix(mediaType, "text/") || textMediaTypes[mediaType] ||
+           textFileExtensions[strings.ToLower(filepath.Ext(attachment.Filename))]
+}
+
+// This function downloads attachment from Discord.  It returns an error if the download fails, is
+// canceled by ctx, or the attachment is larger than maxBytes.
+func downloadAttachment(ctx context.Context, attachment *discordgo.MessageAttachment, maxBytes int) ([]byte, error) {
+    req, err := http.NewRequestWithContext(ctx, "GET", attachment.URL, nil)
+
+    if err != nil {
+        return nil, err
+    }
+
+    httpResponse, err := attachmentClient.Do(req)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer httpResponse.Body.Close()
+
+    if httpResponse.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("HTTP error: %v", httpResponse.Status)
+    }
+
+    // Read one byte more than allowed, to detect attachments that are too large.
+    data, err := io.ReadAll(io.LimitReader(httpResponse.Body, int64(maxBytes)+1))
+
+    if err != nil {
+        return nil, err
+    }
+
+    if len(data) > maxBytes {
+        return nil, fmt.Errorf("attachment is larger than %v bytes", maxBytes)
+    }
+
+    return data, nil
+}
+
+// This function formats byteCount for people to read (e.g., "5 MB").
+func formatByteCount(byteCount int) string {
+    switch {
+    case byteCount >= 1024*1024 && byteCount % (1024*1024) == 0:
+        return fmt.Sprintf("%v MB", byteCount/(1024*1024))
+    case byteCount >= 1024*1024:
+        return fmt.Sprintf("%.1f MB", float64(byteCount)/(1024*1024))
+    case byteCount >= 1024:
+        return fmt.Sprintf("%v KB", byteCount/1024)
+    default:
+        return fmt.Sprintf("%v bytes", byteCount)
+    }
+}
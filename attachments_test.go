@@ -0,0 +1,72 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+// This test attaches more images and text than fit in the history token budget, and checks that
+// loadAttachments counts both against the budget, skipping the attachments that don't fit.
+func TestAttachmentTokenBudget(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+        if strings.HasSuffix(req.URL.Path, ".png") {
+            writer.Write([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"))
+        } else {
+            writer.Write([]byte(strings.Repeat("log line\n", 400)))
+        }
+    }))
+
+    defer server.Close()
+
+    cfg := defaultConfig()
+    query := &Query{Text: "What's wrong here?"}
+
+    // Leave room for the query, two images, and a bit more.
+    cfg.History.ContextTokens += 2*IMAGE_TOKENS + 500 - queryAttachmentBudget(cfg, query)
+
+    attachment := func(fileName string, contentType string) *discordgo.MessageAttachment {
+        return &discordgo.MessageAttachment{URL: server.URL + "/" + fileName, Filename: fileName,
+                                            ContentType: contentType, Size: 100}
+    }
+
+    query.Attachments = []*discordgo.MessageAttachment{
+        attachment("one.png", "image/png"),
+        attachment("two.png", "image/png"),
+        attachment("three.png", "image/png"),
+        attachment("big.log", "text/plain"),
+    }
+
+    skipped := loadAttachments(context.Background(), cfg, query)
+
+    if len(query.Images) != 2 || query.Images[0].Name != "one.png" || query.Images[1].Name != "two.png" {
+        t.Fatalf("loaded images %+v, expected one.png and two.png", query.Images)
+    }
+
+    // The text file (about 900 tokens) doesn't fit after the two images either.
+    if len(query.Documents) != 0 || len(skipped) != 2 || !strings.Contains(skipped[0], "'three.png'") ||
+       !strings.Contains(skipped[1], "'big.log'") {
+        t.Fatalf("loaded %v text files and skipped %q, expected three.png and big.log skipped",
+                 len(query.Documents), skipped)
+    }
+
+    // Without the images, the text file fits, and leaves room for one image.
+    query.Images = nil
+    query.Attachments = []*discordgo.MessageAttachment{
+        attachment("big.log", "text/plain"),
+        attachment("one.png", "image/png"),
+        attachment("two.png", "image/png"),
+    }
+
+    skipped = loadAttachments(context.Background(), cfg, query)
+
+    if len(query.Documents) != 1 || len(query.Images) != 1 || len(skipped) != 1 ||
+       !strings.Contains(skipped[0], "'two.png'") {
+        t.Fatalf("loaded %v text files and %v images and skipped %q, expected two.png skipped",
+                 len(query.Documents), len(query.Images), skipped)
+    }
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+// Reacting to a query's message with this emoji cancels the query.
+const CANCEL_EMOJI = "❌"
+
+// The cause of the cancellation of a query that its user canceled.
+var errQueryCanceled = errors.New("the query was canceled")
+
+var (
+    // The queries that are waiting or being answered, keyed by the ID of the message containing the
+    // query, so that they can be canceled.  Slash commands have no message, so they aren't here.
+    pendingQueries = make(map[string]*pendingQuery)
+
+    // Mutex protecting pendingQueries from concurrent access.
+    pendingQueriesMu sync.Mutex
+)
+
+// A pendingQuery is a query that is waiting or being answered.
+type pendingQuery struct {
+    // The ID of the user who sent the query.
+    userID string
+
+    // Cancels the context used to answer the query.
+    cancel context.CancelCauseFunc
+}
+
+// This function returns the context used to answer query, which is canceled (with cause
+// errQueryCanceled) if the query's message is deleted or its user reacts to it with CANCEL_EMOJI,
+// and a function that must be called when the query has been answered.
+func trackQuery(query *Query) (context.Context, func()) {
+    ctx, cancel := context.WithCancelCause(context.Background())
+
+    if query.MessageID == "" {
+        return ctx, func() { cancel(nil) }
+    }
+
+    pendingQueriesMu.Lock()
+    pendingQueries[query.MessageID] = &pendingQuery{userID: query.UserID, cancel: cancel}
+    pendingQueriesMu.Unlock()
+
+    return ctx, func() {
+        pendingQueriesMu.Lock()
+        delete(pendingQueries, query.MessageID)
+        pendingQueriesMu.Unlock()
+
+        cancel(nil)
+    }
+}
+
+// This function cancels the pending query in the message identified by messageID, if there is one
+// and allowed returns true for the ID of the user who sent it.
+func cancelQuery(messageID string, allowed func(userID string) bool) {
+    pendingQueriesMu.Lock()
+    query := pendingQueries[messageID]
+    pendingQueriesMu.Unlock()
+
+    if query != nil && allowed(query.userID) {
+        query.cancel(errQueryCanceled)
+    }
+}
+
+// This function will be called (due to AddHandler) every time a message is deleted.  If the message
+// contains a pending query, the query is canceled, because nobody can see its answer anyway.
+func handleMessageDeleteEvent(session *discordgo.Session, messageDeleteEvent *discordgo.MessageDelete) {
+    cancelQuery(messageDeleteEvent.ID, func(userID string) bool { return true })
+}
+
+// This function will be called (due to AddHandler) every time someone reacts to a message.  If the
+// reaction is CANCEL_EMOJI, and the message contains a pending query sent by the person reacting or
+// the person reacting is the bot's owner, the query is canceled.
+func handleMessageReactionAddEvent(session *discordgo.Session, reactionAddEvent *discordgo.MessageReactionAdd) {
+    if reactionAddEvent.Emoji.Name != CANCEL_EMOJI {
+        return
+    }
+
+    cfg := currentConfig()
+
+    allowed := func(userID string) bool {
+        return reactionAddEvent.UserID == userID || reactionAddEvent.UserID == cfg.Discord.OwnerID
+    }
+
+    cancelQuery(reactionAddEvent.MessageID, allowed)
+}
+
+// This function returns what to tell the user when the request to the AI for a query was stopped
+// because its context, ctx, was canceled or timed out, using the settings in cfg.
+func canceledQueryMessage(cfg *Config, ctx context.Context) string {
+    switch cause := context.Cause(ctx); {
+    case errors.Is(cause, errQueryCanceled):
+        return "*Canceled.*"
+    case errors.Is(cause, errShuttingDown):
+        return "Sorry, I'm shutting down, so I can't finish that answer."
+    case errors.Is(cause, context.DeadlineExceeded):
+        return fmt.Sprintf("Sorry, I gave up because the AI took longer than %v to answer.", cfg.AI.RequestTimeout)
+    default:
+        return fmt.Sprintf("Sorry, the request to the AI was stopped: %v", cause)
+    }
+}
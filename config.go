@@ -0,0 +1,594 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "regexp"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// A Config holds all of the bot's settings.  The settings come from (in increasing order of
+// precedence) the defaults in defaultConfig, the configuration file named by switch --config, and
+// the other command-line switches.  See disbot.example.yaml for a description of each setting.
+type Config struct {
+    AI      AIConfig      `yaml:"ai"`
+    History HistoryConfig `yaml:"history"`
+    Discord DiscordConfig `yaml:"discord"`
+
+    Attachments AttachmentsConfig `yaml:"attachments"`
+    Usage       UsageConfig       `yaml:"usage"`
+    Quotas      QuotasConfig      `yaml:"quotas"`
+    RateLimits  RateLimitsConfig  `yaml:"rate_limits"`
+    Dispatch    DispatchConfig    `yaml:"dispatch"`
+
+    // The directory where persistent state (e.g., conversation histories) is kept.  If this is
+    // the empty string, nothing is persisted.
+    DataDir string `yaml:"data_dir"`
+
+    // The AI backend created from the AI settings.  Each Config has its own backend, so that a
+    // request that started before the configuration was reloaded keeps using the backend it
+    // started with.
+    backend Backend
+}
+
+// Settings for the AI backend and the requests sent to it.
+type AIConfig struct {
+    Backend        string        `yaml:"backend"`
+    Model          string        `yaml:"model"`
+    BaseURL        string        `yaml:"base_url"`
+    MaxTokens      int           `yaml:"max_tokens"`
+    Reasoning      bool          `yaml:"reasoning"`
+    ThinkingBudget int           `yaml:"thinking_budget"`
+    WebSearch      bool          `yaml:"web_search"`
+    MaxWebSearches int           `yaml:"max_web_searches"`
+    ShowSources    bool          `yaml:"show_sources"`
+    Streaming      bool          `yaml:"streaming"`
+    SystemPrompt   string        `yaml:"system_prompt"`
+    RequestTimeout time.Duration `yaml:"request_timeout"`
+    Retry          RetryConfig   `yaml:"retry"`
+}
+
+// Settings for retrying requests to the AI that fail because its API is overloaded, rate limited,
+// or unreachable.  See withRetries.
+type RetryConfig struct {
+    // The most times each request is sent, including the first.  1 means no retries.
+    MaxAttempts int `yaml:"max_attempts"`
+
+    // The delay before the first retry, which doubles after each retry, up to MaxDelay.
+    InitialDelay time.Duration `yaml:"initial_delay"`
+    MaxDelay     time.Duration `yaml:"max_delay"`
+
+    // How long to keep retrying a request, counting from when it was first sent.
+    Deadline time.Duration `yaml:"deadline"`
+}
+
+// Settings for conversation history.
+type HistoryConfig struct {
+    MaxMessages   int    `yaml:"max_messages"`
+    ContextTokens int    `yaml:"context_tokens"`
+    Summarize     bool   `yaml:"summarize"`
+    SummaryModel  string `yaml:"summary_model"`
+}
+
+// Settings for computing the cost of the AI's token usage.
+type UsageConfig struct {
+    // The price of each model, keyed by model name.  A model without a price of its own uses the
+    // price of the longest name that its name starts with (e.g., "claude-sonnet-4" for
+    // "claude-sonnet-4-20250514").
+    Prices map[string]ModelPrice `yaml:"prices"`
+
+    // The price of 1000 Web searches in US dollars.
+    WebSearchPrice float64 `yaml:"web_search_price"`
+}
+
+// The price of a model in US dollars per million tokens.
+type ModelPrice struct {
+    Input      float64 `yaml:"input"`
+    Output     float64 `yaml:"output"`
+    CacheWrite float64 `yaml:"cache_write"`
+    CacheRead  float64 `yaml:"cache_read"`
+}
+
+// Settings for the dispatcher that runs queries to the AI.  See Dispatcher.
+type DispatchConfig struct {
+    // The most queries that are sent to the AI at once.  This is only used at startup.
+    MaxConcurrent int `yaml:"max_concurrent"`
+
+    // The most queries in each conversation that can wait for the one being answered.
+    MaxWaiting int `yaml:"max_waiting"`
+
+    // How long the bot waits for the queries being answered (and waiting) to be answered when it
+    // shuts down, before canceling them.
+    ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+}
+
+// Settings that limit how often queries can be sent to the AI.  See checkRateLimits.
+type RateLimitsConfig struct {
+    // The limits for each user (in all channels), for each conversation, and for the whole bot.
+    User         RateLimit `yaml:"user"`
+    Conversation RateLimit `yaml:"conversation"`
+    Global       RateLimit `yaml:"global"`
+
+    // The IDs of the server roles whose members aren't limited.  The bot's owner is never limited.
+    ExemptRoles []string `yaml:"exempt_roles"`
+}
+
+// The limits of one token bucket: up to Burst queries can be sent at once, and then one more every
+// Interval.  An Interval of 0 means no limit.
+type RateLimit struct {
+    Interval time.Duration `yaml:"interval"`
+    Burst    int           `yaml:"burst"`
+}
+
+// Settings that limit how many tokens people can use.  See checkQuotas.
+type QuotasConfig struct {
+    // The quotas of each user, each channel, and each server.
+    User    QuotaLimits `yaml:"user"`
+    Channel QuotaLimits `yaml:"channel"`
+    Guild   QuotaLimits `yaml:"guild"`
+
+    // The IDs of users who have no quotas.  The bot's owner never has quotas.
+    ExemptUsers []string `yaml:"exempt_users"`
+}
+
+// The limits of one quota.  A limit of 0 means no limit.
+type QuotaLimits struct {
+    DailyTokens    int     `yaml:"daily_tokens"`
+    MonthlyTokens  int     `yaml:"monthly_tokens"`
+    DailyDollars   float64 `yaml:"daily_dollars"`
+    MonthlyDollars float64 `yaml:"monthly_dollars"`
+}
+
+// Settings for the files attached to messages sent to the AI.
+type AttachmentsConfig struct {
+    // Send image attachments to the AI, which can see them.
+    Images bool `yaml:"images"`
+
+    // The largest image (in bytes) sent to the AI, and the most images per message.
+    MaxImageBytes int `yaml:"max_image_bytes"`
+    MaxImages     int `yaml:"max_images"`
+
+    // Send text files (e.g., logs and source code) attached to messages to the AI.
+    TextFiles bool `yaml:"text_files"`
+
+    // The largest text file (in bytes) sent to the AI, and the most text files per message.
+    MaxTextBytes int `yaml:"max_text_bytes"`
+    MaxTextFiles int `yaml:"max_text_files"`
+}
+
+// Settings for the bot's behavior on Discord.
+type DiscordConfig struct {
+    GuildID       string        `yaml:"guild_id"`
+    OwnerID       string        `yaml:"owner_id"`
+    OwnerName     string        `yaml:"owner_name"`
+    MaxInputChars int           `yaml:"max_input_chars"`
+
+    // The number of messages in a reply chain that are quoted as context when a query is a reply
+    // to another message, or 0 to quote nothing.
+    ReplyContextDepth int `yaml:"reply_context_depth"`
+
+    SlashCommands SlashCommandsConfig `yaml:"slash_commands"`
+    Triggers      TriggersConfig      `yaml:"triggers"`
+    Threads       ThreadsConfig       `yaml:"threads"`
+}
+
+// Settings for the bot's behavior in threads.
+type ThreadsConfig struct {
+    // Answers longer than this many characters to messages in a server's text channels are posted
+    // in a new thread started from the message, or 0 to never start threads.
+    AutoThreadChars int `yaml:"auto_thread_chars"`
+
+    // Give the AI the message that started a thread along with the first query in the thread.
+    SeedFromStarter bool `yaml:"seed_from_starter"`
+}
+
+// Settings that choose which messages, besides those starting with '!', are sent to the AI.
+type TriggersConfig struct {
+    // Messages that mention the bot.
+    Mention bool `yaml:"mention"`
+
+    // Replies to the bot's messages.
+    Reply bool `yaml:"reply"`
+
+    // All messages in DMs.
+    DM bool `yaml:"dm"`
+}
+
+// Settings for the bot's slash commands.  These are only used at startup, when the commands are
+// registered with Discord.
+type SlashCommandsConfig struct {
+    Enabled bool `yaml:"enabled"`
+
+    // Where the commands are registered: "global" (every server and DMs) or "guild" (only the
+    // server identified by DiscordConfig.GuildID).
+    Scope string `yaml:"scope"`
+}
+
+// The default system prompt.  getSystemPrompt adds today's date and other context to this.
+const DEFAULT_SYSTEM_PROMPT = "You are a helpful assistant that provides concise and accurate answers " +
+    "to user queries. Your responses should be short: only 2 or 3 sentences."
+
+var (
+    // The active configuration.  This is set in main() by loadConfiguration, and replaced by
+    // reloadConfiguration.  A Config is never modified after it is stored here, so code that
+    // handles a message gets a snapshot with currentConfig() once and uses it throughout.
+    activeConfig atomic.Pointer[Config]
+
+    // Mutex serializing calls to reloadConfiguration.
+    reloadMu sync.Mutex
+
+    // The path of the configuration file, or the empty string if there is none.  Switch --config
+    // sets this.
+    configPath = ""
+
+    // Functions that apply the command-line switches (other than --config) to a Config.  These are
+    // applied after the configuration file is read, so that switches override the file.
+    commandLineOverrides []func(cfg *Config)
+
+    // Matches a Discord ID (a "snowflake").
+    discordIDPattern = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// This function returns a Config holding the default settings.
+func defaultConfig() *Config {
+    return &Config{
+        AI: AIConfig{
+            Backend:        "anthropic",
+            MaxTokens:      2048,
+            Reasoning:      true,
+            ThinkingBudget: 1024,
+            WebSearch:      true,
+            MaxWebSearches: 1,
+            ShowSources:    true,
+            Streaming:      true,
+            SystemPrompt:   DEFAULT_SYSTEM_PROMPT,
+            RequestTimeout: 5 * time.Minute,
+            Retry: RetryConfig{
+                MaxAttempts:  5,
+                InitialDelay: time.Second,
+                MaxDelay:     30 * time.Second,
+                Deadline:     2 * time.Minute,
+            },
+        },
+        History: HistoryConfig{
+            MaxMessages:   DEFAULT_MAX_RECENT_MESSAGES,
+            ContextTokens: DEFAULT_CONTEXT_TOKENS,
+            Summarize:     true,
+        },
+        Attachments: AttachmentsConfig{
+            Images:        true,
+            MaxImageBytes: 5 * 1024 * 1024,
+            MaxImages:     4,
+            TextFiles:     true,
+            MaxTextBytes:  16 * 1024,
+            MaxTextFiles:  3,
+        },
+        Dispatch: DispatchConfig{
+            MaxConcurrent:       4,
+            MaxWaiting:          3,
+            ShutdownGracePeriod: 30 * time.Second,
+        },
+        RateLimits: RateLimitsConfig{
+            User:         RateLimit{Interval: 20 * time.Second, Burst: 3},
+            Conversation: RateLimit{Interval: 10 * time.Second, Burst: 3},
+            Global:       RateLimit{Interval: 2 * time.Second, Burst: 10},
+        },
+        Usage: UsageConfig{
+            // Anthropic's prices as of 2025.
+            Prices: map[string]ModelPrice{
+                "claude-opus-4":     {Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.50},
+                "claude-sonnet-4":   {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.30},
+                "claude-3-7-sonnet": {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.30},
+                "claude-3-5-haiku":  {Input: 0.80, Output: 4, CacheWrite: 1, CacheRead: 0.08},
+            },
+            WebSearchPrice: 10,
+        },
+        Discord: DiscordConfig{
+            GuildID:           "840286104296489000",
+            OwnerID:           "555030984706359296",
+            OwnerName:         "Fran",
+            MaxInputChars:     1000,
+            ReplyContextDepth: 1,
+            SlashCommands: SlashCommandsConfig{
+                Enabled: true,
+                Scope:   "global",
+            },
+            Triggers: TriggersConfig{
+                Mention: true,
+                Reply:   true,
+                DM:      true,
+            },
+            Threads: ThreadsConfig{
+                AutoThreadChars: 0,
+                SeedFromStarter: true,
+            },
+        },
+    }
+}
+
+// This method returns true if the AI thinks before it answers: the ai.reasoning setting is true and
+// the backend supports extended thinking.  Only the anthropic backend does.
+func (cfg *Config) reasoningEnabled() bool {
+    return cfg.AI.Reasoning && cfg.AI.Backend == "anthropic"
+}
+
+// This method returns true if the AI can search the Web: the ai.web_search setting is true and the
+// backend supports Web search.  Only the anthropic backend does.
+func (cfg *Config) webSearchEnabled() bool {
+    return cfg.AI.WebSearch && cfg.AI.Backend == "anthropic"
+}
+
+// This function returns the active configuration.  The caller must not modify it.
+func currentConfig() *Config {
+    return activeConfig.Load()
+}
+
+// This function builds the configuration from the defaults, the configuration file at configPath
+// (if it's not the empty string), and the command-line switches, then validates it and creates its
+// AI backend.  It returns an error describing every problem found.
+func loadConfiguration() (*Config, error) {
+    cfg := defaultConfig()
+
+    if configPath != "" {
+        configBytes, err := os.ReadFile(configPath)
+
+        if err != nil {
+            return nil, fmt.Errorf("cannot read configuration file: %v", err)
+        }
+
+        // Settings missing from the file keep their default values.  Unknown settings are errors,
+        // because they're probably misspellings.
+        decoder := yaml.NewDecoder(bytes.NewReader(configBytes))
+        decoder.KnownFields(true)
+
+        if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+            return nil, fmt.Errorf("configuration file %v: %v", configPath, err)
+        }
+    }
+
+    for _, override := range commandLineOverrides {
+        override(cfg)
+    }
+
+    // Summarize with a cheaper model than the one that talks to users, unless told otherwise.
+    if cfg.History.SummaryModel == "" && cfg.AI.Backend == "anthropic" {
+        cfg.History.SummaryModel = DEFAULT_ANTHROPIC_SUMMARY_MODEL
+    }
+
+    if err := cfg.validate(); err != nil {
+        if configPath != "" {
+            return nil, fmt.Errorf("invalid configuration (from %v and the command line):\n%v", configPath, err)
+        }
+
+        return nil, fmt.Errorf("invalid configuration:\n%v", err)
+    }
+
+    // Create the AI backend.  The backend gets its API key (if any) from an environment variable.
+    backend, err := newBackend(cfg)
+
+    if err != nil {
+        return nil, err
+    }
+
+    cfg.backend = backend
+
+    return cfg, nil
+}
+
+// This function re-reads the configuration file and makes the new configuration active.  Requests
+// that are being processed finish with the configuration they started with.  If the new
+// configuration is invalid, the active configuration is unchanged and the error is returned.
+// Settings that are only used at startup (e.g., data_dir) keep their old values until restart.
+func reloadConfiguration() error {
+    reloadMu.Lock()
+    defer reloadMu.Unlock()
+
+    newConfig, err := loadConfiguration()
+
+    if err != nil {
+        return err
+    }
+
+    oldConfig := currentConfig()
+
+    if newConfig.DataDir != oldConfig.DataDir {
+        fmt.Printf("%v: reloadConfiguration: Changing data_dir requires a restart.  Still using '%v'.\n",
+                   Me, oldConfig.DataDir)
+        newConfig.DataDir = oldConfig.DataDir
+    }
+
+    if newConfig.Dispatch.MaxConcurrent != oldConfig.Dispatch.MaxConcurrent {
+        fmt.Printf("%v: reloadConfiguration: Changing dispatch.max_concurrent requires a restart.  Still using %v.\n",
+                   Me, oldConfig.Dispatch.MaxConcurrent)
+        newConfig.Dispatch.MaxConcurrent = oldConfig.Dispatch.MaxConcurrent
+    }
+
+    activeConfig.Store(newConfig)
+
+    fmt.Printf("%v: Configuration reloaded.\n", Me)
+    return nil
+}
+
+// This function checks that the settings in cfg make sense together.  It returns an error
+// describing every problem found, one per line, or nil if there are none.
+func (cfg *Config) validate() error {
+    var problems []error
+
+    problem := func(format string, args ...any) {
+        problems = append(problems, fmt.Errorf("  "+format, args...))
+    }
+
+    switch cfg.AI.Backend {
+    case "anthropic", "openai":
+    default:
+        problem("ai.backend: unknown backend '%v' (must be 'anthropic' or 'openai')", cfg.AI.Backend)
+    }
+
+    if cfg.AI.MaxTokens <= 0 {
+        problem("ai.max_tokens (%v) must be greater than 0", cfg.AI.MaxTokens)
+    }
+
+    if cfg.AI.Reasoning {
+        // Claude's API fails with HTTP error 400 (Bad Request) if either of these is violated.
+        if cfg.AI.ThinkingBudget < 1024 {
+            problem("ai.thinking_budget (%v) must be at least 1024", cfg.AI.ThinkingBudget)
+        }
+
+        if cfg.AI.ThinkingBudget >= cfg.AI.MaxTokens {
+            problem("ai.thinking_budget (%v) must be smaller than ai.max_tokens (%v)",
+                    cfg.AI.ThinkingBudget, cfg.AI.MaxTokens)
+        }
+    }
+
+    if cfg.AI.WebSearch && cfg.AI.MaxWebSearches <= 0 {
+        problem("ai.max_web_searches (%v) must be greater than 0 when ai.web_search is true",
+                cfg.AI.MaxWebSearches)
+    }
+
+    if cfg.AI.SystemPrompt == "" {
+        problem("ai.system_prompt must not be empty")
+    }
+
+    if cfg.AI.RequestTimeout <= 0 {
+        problem("ai.request_timeout (%v) must be greater than 0", cfg.AI.RequestTimeout)
+    }
+
+    if cfg.AI.Retry.MaxAttempts < 1 {
+        problem("ai.retry.max_attempts (%v) must be at least 1", cfg.AI.Retry.MaxAttempts)
+    }
+
+    if cfg.AI.Retry.InitialDelay <= 0 {
+        problem("ai.retry.initial_delay (%v) must be greater than 0", cfg.AI.Retry.InitialDelay)
+    }
+
+    if cfg.AI.Retry.MaxDelay < cfg.AI.Retry.InitialDelay {
+        problem("ai.retry.max_delay (%v) must not be smaller than ai.retry.initial_delay (%v)",
+                cfg.AI.Retry.MaxDelay, cfg.AI.Retry.InitialDelay)
+    }
+
+    if cfg.AI.Retry.Deadline < 0 {
+        problem("ai.retry.deadline (%v) must not be negative", cfg.AI.Retry.Deadline)
+    }
+
+    if cfg.History.MaxMessages < 0 || cfg.History.MaxMessages % 2 != 0 {
+        problem("history.max_messages (%v) must be 0 (no limit) or a positive even number, because " +
+                "the history holds pairs of user/AI messages", cfg.History.MaxMessages)
+    }
+
+    if cfg.History.ContextTokens <= 0 {
+        problem("history.context_tokens (%v) must be greater than 0", cfg.History.ContextTokens)
+    } else if budget := historyTokenBudget(cfg); budget <= 0 {
+        problem("history.context_tokens (%v) leaves no room for conversation history after the " +
+                "system prompt and ai.max_tokens (%v); it must be at least %v",
+                cfg.History.ContextTokens, cfg.AI.MaxTokens, cfg.History.ContextTokens-budget+1)
+    }
+
+    if cfg.Attachments.MaxImageBytes <= 0 {
+        problem("attachments.max_image_bytes (%v) must be greater than 0", cfg.Attachments.MaxImageBytes)
+    }
+
+    if cfg.Attachments.MaxImages < 0 {
+        problem("attachments.max_images (%v) must not be negative", cfg.Attachments.MaxImages)
+    }
+
+    if cfg.Attachments.MaxTextBytes <= 0 {
+        problem("attachments.max_text_bytes (%v) must be greater than 0", cfg.Attachments.MaxTextBytes)
+    }
+
+    if cfg.Attachments.MaxTextFiles < 0 {
+        problem("attachments.max_text_files (%v) must not be negative", cfg.Attachments.MaxTextFiles)
+    }
+
+    for model, price := range cfg.Usage.Prices {
+        if price.Input < 0 || price.Output < 0 || price.CacheWrite < 0 || price.CacheRead < 0 {
+            problem("usage.prices for model '%v' must not be negative", model)
+        }
+    }
+
+    if cfg.Usage.WebSearchPrice < 0 {
+        problem("usage.web_search_price (%v) must not be negative", cfg.Usage.WebSearchPrice)
+    }
+
+    for index, limits := range []QuotaLimits{cfg.Quotas.User, cfg.Quotas.Channel, cfg.Quotas.Guild} {
+        if limits.DailyTokens < 0 || limits.MonthlyTokens < 0 || limits.DailyDollars < 0 || limits.MonthlyDollars < 0 {
+            problem("quotas.%v must not be negative", []string{"user", "channel", "guild"}[index])
+        }
+    }
+
+    for _, userID := range cfg.Quotas.ExemptUsers {
+        if !discordIDPattern.MatchString(userID) {
+            problem("quotas.exempt_users contains '%v', which is not a Discord user ID", userID)
+        }
+    }
+
+    if cfg.Discord.GuildID != "" && !discordIDPattern.MatchString(cfg.Discord.GuildID) {
+        problem("discord.guild_id ('%v') must be a Discord server ID (all digits)", cfg.Discord.GuildID)
+    }
+
+    if cfg.Discord.OwnerID != "" && !discordIDPattern.MatchString(cfg.Discord.OwnerID) {
+        problem("discord.owner_id ('%v') must be a Discord user ID (all digits)", cfg.Discord.OwnerID)
+    }
+
+    if cfg.Discord.MaxInputChars <= 0 {
+        problem("discord.max_input_chars (%v) must be greater than 0", cfg.Discord.MaxInputChars)
+    }
+
+    if cfg.Dispatch.MaxConcurrent < 1 {
+        problem("dispatch.max_concurrent (%v) must be at least 1", cfg.Dispatch.MaxConcurrent)
+    }
+
+    if cfg.Dispatch.MaxWaiting < 0 {
+        problem("dispatch.max_waiting (%v) must not be negative", cfg.Dispatch.MaxWaiting)
+    }
+
+    if cfg.Dispatch.ShutdownGracePeriod < 0 {
+        problem("dispatch.shutdown_grace_period (%v) must not be negative", cfg.Dispatch.ShutdownGracePeriod)
+    }
+
+    for index, limit := range []RateLimit{cfg.RateLimits.User, cfg.RateLimits.Conversation, cfg.RateLimits.Global} {
+        name := []string{"user", "conversation", "global"}[index]
+
+        if limit.Interval < 0 {
+            problem("rate_limits.%v.interval (%v) must not be negative", name, limit.Interval)
+        }
+
+        if limit.Interval > 0 && limit.Burst < 1 {
+            problem("rate_limits.%v.burst (%v) must be at least 1", name, limit.Burst)
+        }
+    }
+
+    for _, roleID := range cfg.RateLimits.ExemptRoles {
+        if !discordIDPattern.MatchString(roleID) {
+            problem("rate_limits.exempt_roles contains '%v', which is not a Discord role ID", roleID)
+        }
+    }
+
+    if cfg.Discord.ReplyContextDepth < 0 || cfg.Discord.ReplyContextDepth > MAX_REPLY_CONTEXT_DEPTH {
+        problem("discord.reply_context_depth (%v) must be between 0 and %v", cfg.Discord.ReplyContextDepth,
+                MAX_REPLY_CONTEXT_DEPTH)
+    }
+
+    if cfg.Discord.Threads.AutoThreadChars < 0 {
+        problem("discord.threads.auto_thread_chars (%v) must be 0 (never start threads) or greater",
+                cfg.Discord.Threads.AutoThreadChars)
+    }
+
+    switch cfg.Discord.SlashCommands.Scope {
+    case "global":
+    case "guild":
+        if cfg.Discord.GuildID == "" {
+            problem("discord.slash_commands.scope is 'guild', but discord.guild_id is empty")
+        }
+    default:
+        problem("discord.slash_commands.scope ('%v') must be 'global' or 'guild'", cfg.Discord.SlashCommands.Scope)
+    }
+
+    return errors.Join(problems...)
+}
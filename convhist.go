@@ -4,106 +4,319 @@ import (
     "container/list"
     "fmt"
     "sync"
+
+    "github.com/bwmarrin/discordgo"
 )
 
 var (
     // This map stores per-conversation message history. The key is a conversation key
-    // (produced by conversationKey()), and the value is a List of maps of the form:
+    // (produced by conversationKey()), and the value is a List of HistoryMessages of the form:
     //
-    //  {{ "role": "user",      "content": "..." }
-    //   { "role": "assistant", "content": "..." }
-    //   { "role": "user",      "content": "..." }
-    //   { "role": "assistant", "content": "..." }
+    //  {{ Role: "user",      Content: [...], AuthorID: "...", AuthorName: "..." }
+    //   { Role: "assistant", Content: [...] }
+    //   { Role: "user",      Content: [...], AuthorID: "...", AuthorName: "..." }
+    //   { Role: "assistant", Content: [...] }
     //   ...
     //  }
     //
-    // where the "role" alternates between "user" and "assistant", and the "content" is the
-    // text of the message. The newest element of each list is List.Front(), and the oldest
-    // is List.Back().
+    // where the Role alternates between "user" and "assistant", the Content holds the text
+    // (and images) of the message as ContentBlocks, and the AuthorID and AuthorName identify
+    // who sent each user message. The newest element of each list is List.Front(), and the
+    // oldest is List.Back(). A conversation's list is loaded from historyStore the first time
+    // the conversation is used.
     recentMessages = make(map[string]*List, 10)
 
-    // Mutex protecting recentMessages from concurrent access.
+    // The number of messages in each conversation's log in historyStore. When this grows
+    // well beyond the length of the conversation's list, the log is rewritten to hold only
+    // the messages in the list.
+    storedMessageCounts = make(map[string]int, 10)
+
+    // Mutex protecting recentMessages and storedMessageCounts from concurrent access.
     recentMessagesMu sync.Mutex
+
+    // The store where conversation histories are persisted. The data_dir setting (or switch
+    // --data-dir) replaces this with a store that keeps histories on disk.
+    historyStore HistoryStore = newMemoryHistoryStore()
 )
 
-// conversationKey returns the stable key under which a conversation's history is
-// stored. DMs are keyed by user ID; channels by channel ID. IDs are used instead
-// of display names because names can change or collide.
-func conversationKey(channelID string, userID string, isDM bool) string {
-    if isDM {
+// conversationKey returns the stable key under which the history of a conversation in
+// channel is stored. DMs are keyed by user ID; threads by thread ID; channels by channel
+// ID. IDs are used instead of display names because names can change or collide.
+func conversationKey(channel *discordgo.Channel, userID string) string {
+    if isDMChannel(channel) {
         return "dm:" + userID
     }
-    return "ch:" + channelID
+    if channel.IsThread() {
+        return threadConversationKey(channel.ID)
+    }
+    return "ch:" + channel.ID
+}
+
+// threadConversationKey returns the conversation key of the thread identified by threadID.
+func threadConversationKey(threadID string) string {
+    return "th:" + threadID
+}
+
+// This function returns the List holding the conversation history identified by convKey,
+// loading it from historyStore if this is the first time the conversation has been used.
+// The history window is determined by the settings in cfg. The caller must hold recentMessagesMu.
+func historyGetList(cfg *Config, convKey string) *List {
+    messageList := recentMessages[convKey]
+
+    if messageList != nil {
+        return messageList
+    }
+
+    // Initialize a new list for this conversation and add it to the recentMessages map
+    // using the conversation key.
+    messageList = list.New()
+    recentMessages[convKey] = messageList
+
+    storedMessages, err := historyStore.Load(convKey)
+
+    if err != nil {
+        // Carry on with an empty history rather than refusing to talk.
+        fmt.Printf("%v: historyGetList: Error loading history for \"%s\": %v\n", Me, convKey, err)
+        return messageList
+    }
+
+    storedMessageCounts[convKey] = len(storedMessages)
+
+    // Keep only the stored messages that form user/assistant pairs, to maintain the invariant
+    // that the list contains pairs of "user" and "assistant" elements.
+    pairedMessages := pairHistoryMessages(storedMessages)
+
+    if droppedCount := len(storedMessages) - len(pairedMessages); droppedCount > 0 {
+        fmt.Printf("%v: historyGetList: Dropped %v unpaired stored %v from \"%s\"\n", Me, droppedCount,
+                   plural(droppedCount, "message", "messages"), convKey)
+    }
+
+    // Push the messages from oldest to newest, so the newest ends up at the front.
+    for _, message := range pairedMessages {
+        messageList.PushFront(message)
+    }
+
+    // Keep only as many messages as fit the history window. Messages trimmed here were
+    // already folded into the conversation's summary (if any) when they were first trimmed,
+    // and are only still in the store because its log hasn't been rewritten since.
+    historyTrim(cfg, messageList)
+
+    return messageList
+}
+
+// This function returns the messages in messages (oldest first) that are user messages followed by
+// an assistant message, and those assistant messages.  The others are unpaired: e.g., an unanswered
+// user message left by a bot that stopped before the AI replied, or the message after a line that a
+// crash left partially written, which is skipped when the log is loaded.  The AI's API rejects a
+// conversation whose messages don't alternate.
+func pairHistoryMessages(messages []HistoryMessage) []HistoryMessage {
+    pairedMessages := make([]HistoryMessage, 0, len(messages))
+
+    for index := 0; index+1 < len(messages); index++ {
+        if messages[index].Role == "user" && messages[index+1].Role == "assistant" {
+            pairedMessages = append(pairedMessages, messages[index], messages[index+1])
+            index++
+        }
+    }
+
+    return pairedMessages
+}
+
+// This function removes the oldest messages from messageList until the remaining messages
+// fit in the history window, which is limited by historyTokenBudget() and (if it's not zero)
+// the history.max_messages setting in cfg. Messages are removed in user/assistant pairs to
+// maintain the invariant that the list always contains pairs of "user" and "assistant"
+// elements, which alternate in the list. The newest pair (or the newest user message, if it
+// hasn't been answered yet) is never removed, even if it doesn't fit. It returns the removed
+// messages, oldest first. The caller must hold recentMessagesMu.
+func historyTrim(cfg *Config, messageList *List) []HistoryMessage {
+    tokenBudget := historyTokenBudget(cfg)
+    maxMessages := cfg.History.MaxMessages
+
+    totalTokens := 0
+
+    for element := messageList.Front(); element != nil; element = element.Next() {
+        totalTokens += estimateMessageTokens(element.Value.(HistoryMessage))
+    }
+
+    var removedMessages []HistoryMessage
+
+    for messageList.Len() > 2 {
+        overCount := maxMessages > 0 && messageList.Len() > maxMessages
+
+        if !overCount && totalTokens <= tokenBudget {
+            break
+        }
+
+        for range 2 {
+            removedMessage := messageList.Remove(messageList.Back()).(HistoryMessage)
+            totalTokens -= estimateMessageTokens(removedMessage)
+            removedMessages = append(removedMessages, removedMessage)
+        }
+    }
+
+    return removedMessages
+}
+
+// This function returns the number of tokens available for conversation history in each
+// request to the AI when using the settings in cfg. This is whatever remains of the
+// history.context_tokens setting after setting aside room for the system prompt, the
+// conversation summary (if summarization is enabled), and the AI's output. The reasoning
+// budget is part of the output (it must be smaller than max_tokens), so setting aside
+// max_tokens covers it too, unless the reasoning budget is misconfigured to be larger.
+func historyTokenBudget(cfg *Config) int {
+    outputTokens := cfg.AI.MaxTokens
+
+    if cfg.reasoningEnabled() && cfg.AI.ThinkingBudget > outputTokens {
+        outputTokens = cfg.AI.ThinkingBudget
+    }
+
+    systemTokens := estimateTokens(getSystemPrompt(cfg))
+
+    if cfg.History.Summarize {
+        systemTokens += SUMMARY_MAX_TOKENS
+    }
+
+    return cfg.History.ContextTokens - systemTokens - outputTokens
 }
 
-// This function appends a new message (from either the user or the AI) to the conversation
-// history identified by convKey. Parameter role is either "user" or "assistant".
-func historySaveNewMessage(role string, message string, convKey string) {
+// This function returns a rough estimate of the number of tokens in message, including the
+// overhead of the message's role, delimiters, and speaker label.
+func estimateMessageTokens(message HistoryMessage) int {
+    return estimateTokens(speakerLabel(message)+message.text()) + message.imageCount()*IMAGE_TOKENS + 4
+}
+
+// This function returns a rough estimate of the number of tokens in text. Tokenizers differ
+// between models, but English text averages about 4 characters per token. This errs on the
+// high side for text with many short words, which is the safe direction.
+func estimateTokens(text string) int {
+    return (runeCount(text) + 3) / 4
+}
+
+// This function appends an exchange with the AI (userMessage, and assistantMessage, which is the
+// AI's answer to it) to the conversation history identified by convKey, using the history settings
+// in cfg.  Both messages are added at once, and only after the AI has answered, so a failed request
+// leaves the history unchanged and the user/assistant alternation intact.
+func historySaveExchange(cfg *Config, userMessage HistoryMessage, assistantMessage HistoryMessage, convKey string) {
     recentMessagesMu.Lock()
     defer recentMessagesMu.Unlock()
 
-    messageList := recentMessages[convKey]
+    messageList := historyGetList(cfg, convKey)
+
+    // Add the new messages to the front of the list.
+    messageList.PushFront(userMessage)
+    messageList.PushFront(assistantMessage)
 
-    if messageList == nil {
-        // Initialize a new list for this conversation.
-        messageList = list.New()
+    // Remove the oldest user/assistant pairs that no longer fit in the history window.  If
+    // summarization is enabled, the removed messages are folded into the conversation's summary
+    // in the background.
+    removedMessages := historyTrim(cfg, messageList)
 
-        // Add messageList to the recentMessages map using the conversation key.
-        recentMessages[convKey] = messageList
+    if cfg.History.Summarize && len(removedMessages) > 0 {
+        historyQueueSummary(cfg, convKey, removedMessages)
     }
 
-    // Add the new message to the front of the list.
-    messageList.PushFront(map[string]string{"role": role, "content": message})
+    // Persist the change.  The store's log only grows, so rewrite it once it holds twice as
+    // many messages as the list does.
+    var err error
+
+    if storedMessageCounts[convKey] >= 2*messageList.Len() {
+        err = historyStore.Rewrite(convKey, historyListToSlice(messageList))
+        storedMessageCounts[convKey] = messageList.Len()
+    } else {
+        err = historyStore.Append(convKey, userMessage, assistantMessage)
+        storedMessageCounts[convKey] += 2
+    }
 
-    // If the length of messageList equals or exceeds maxRecentMessages + 2, remove the
-    // 2 oldest elements. We remove the 2 oldest to maintain the invariant that the list
-    // always contains pairs of "user" and "assistant" elements, which alternate in the
-    // list. We use 'maxRecentMessages + 2' so that after removing the 2 oldest messages,
-    // there are maxRecentMessages remaining, so the AI will see all of them on the next
-    // user query.
-    if messageList.Len() >= maxRecentMessages+2 {
-        messageList.Remove(messageList.Back())
-        messageList.Remove(messageList.Back())
+    if err != nil {
+        fmt.Printf("%v: historySaveExchange: Error saving history for \"%s\": %v\n", Me, convKey, err)
     }
 
     // For debugging.
-    fmt.Printf("historySaveNewMessage: recentMessages[\"%s\"].Len() = %v\n", convKey, messageList.Len())
+    fmt.Printf("historySaveExchange: recentMessages[\"%s\"].Len() = %v\n", convKey, messageList.Len())
 }
 
-// This function converts the conversation history identified by convKey (a List of maps)
-// into a slice of maps so that it can be marshaled with json.Marshal.
-func historyAsSlice(convKey string) ([]map[string]string, error) {
+// This function returns the number of messages in the conversation history identified by
+// convKey. If the conversation must be loaded from historyStore, it is trimmed to the history
+// window in cfg.
+func historyLength(cfg *Config, convKey string) int {
     recentMessagesMu.Lock()
     defer recentMessagesMu.Unlock()
 
-    messageList := recentMessages[convKey]
+    return historyGetList(cfg, convKey).Len()
+}
+
+// This function copies the newest user/assistant pair in the conversation history identified
+// by fromConvKey to the end of the conversation history identified by toConvKey. It does
+// nothing if the newest message in fromConvKey's history isn't an answered user message.
+func historyCopyLastExchange(cfg *Config, fromConvKey string, toConvKey string) {
+    recentMessagesMu.Lock()
+    fromList := historyGetList(cfg, fromConvKey)
+
+    var exchange []HistoryMessage
 
-    // If there is no history for this conversation yet, return an empty slice.
-    if messageList == nil {
-        return []map[string]string{}, nil
+    if fromList.Len() >= 2 {
+        answer := fromList.Front().Value.(HistoryMessage)
+        question := fromList.Front().Next().Value.(HistoryMessage)
+
+        if question.Role == "user" && answer.Role == "assistant" {
+            exchange = []HistoryMessage{question, answer}
+        }
+    }
+
+    recentMessagesMu.Unlock()
+
+    if exchange != nil {
+        historySaveExchange(cfg, exchange[0], exchange[1], toConvKey)
     }
+}
 
-    // This will hold the slice of messages to be sent in the JSON request.
-    messagesSlice := make([]map[string]string, 0, messageList.Len())
+// This function forgets the conversation history identified by convKey, including its
+// summary, both in memory and in historyStore.
+func historyDelete(convKey string) {
+    recentMessagesMu.Lock()
+    delete(recentMessages, convKey)
+    delete(storedMessageCounts, convKey)
+    recentMessagesMu.Unlock()
+
+    historyForgetSummary(convKey)
+
+    if err := historyStore.Delete(convKey); err != nil {
+        fmt.Printf("%v: historyDelete: Error deleting history for \"%s\": %v\n", Me, convKey, err)
+    }
+}
+
+// This function returns the conversation history identified by convKey followed by newMessage (a
+// user message that hasn't been answered yet), oldest first, so that they can be sent to the AI.
+// The oldest messages are left out if they don't fit in the history window in cfg along with
+// newMessage.  The history itself isn't changed: newMessage is only added to it (by
+// historySaveExchange) once the AI has answered it.
+func historyAsSlice(cfg *Config, convKey string, newMessage HistoryMessage) ([]HistoryMessage, error) {
+    recentMessagesMu.Lock()
+    defer recentMessagesMu.Unlock()
+
+    // Trim a copy of the list holding the new message, which leaves out the same messages that
+    // historySaveExchange will remove when the new message is answered.
+    messageList := list.New()
+    messageList.PushBackList(historyGetList(cfg, convKey))
+    messageList.PushFront(newMessage)
+
+    historyTrim(cfg, messageList)
+
+    return historyListToSlice(messageList), nil
+}
+
+// This function converts messageList into a slice of HistoryMessages, oldest first. The
+// caller must hold recentMessagesMu.
+func historyListToSlice(messageList *List) []HistoryMessage {
+    // This will hold the slice of messages, oldest first.
+    messagesSlice := make([]HistoryMessage, 0, messageList.Len())
 
     // Iterate over the elements of the list from oldest to newest and append each
-    // map to messagesSlice.
+    // message to messagesSlice.
     for element := messageList.Back(); element != nil; element = element.Prev() {
-        // Get the map from the list element.
-        messageMap, ok := element.Value.(map[string]string)
-
-        if !ok {
-            // This should never happen, because we only push instances of
-            // map[string]string into the list.
-            msg := fmt.Sprintf("Error: historyAsSlice: Failed to get map from "+
-                "recentMessages[\"%s\"]!", convKey)
-            fmt.Println(msg)
-            return nil, fmt.Errorf("%s", msg)
-        }
-
-        // Append messageMap to messagesSlice.
-        messagesSlice = append(messagesSlice, messageMap)
+        messagesSlice = append(messagesSlice, element.Value.(HistoryMessage))
     }
 
-    return messagesSlice, nil
+    return messagesSlice
 }
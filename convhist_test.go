@@ -0,0 +1,149 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+// flakyBackend is a StreamingBackend that fails the requests for which fail returns true, and
+// answers the others.  It keeps the messages of every request it gets.
+type flakyBackend struct {
+    fail     func(call int) bool
+    calls    int
+    requests [][]HistoryMessage
+}
+
+func (backend *flakyBackend) Complete(ctx context.Context, request *AIRequest) (*AIResponse, error) {
+    backend.calls++
+    backend.requests = append(backend.requests, request.Messages)
+
+    if backend.fail(backend.calls) {
+        return nil, errors.New("HTTP error: 529 Overloaded")
+    }
+
+    return &AIResponse{Text: fmt.Sprintf("answer %v", backend.calls), Model: "flaky"}, nil
+}
+
+func (backend *flakyBackend) CompleteStream(ctx context.Context, request *AIRequest,
+                                            onDelta func(delta AIDelta)) (*AIResponse, error) {
+    response, err := backend.Complete(ctx, request)
+
+    if err == nil {
+        onDelta(AIDelta{Text: response.Text})
+    }
+
+    return response, err
+}
+
+// This function fails the test if messages don't alternate between "user" and "assistant",
+// starting with "user" and ending with "user" if endsWithUser is true, otherwise "assistant".
+func checkAlternation(t *testing.T, what string, messages []HistoryMessage, endsWithUser bool) {
+    t.Helper()
+
+    for index, message := range messages {
+        expectedRole := []string{"user", "assistant"}[index % 2]
+
+        if message.Role != expectedRole {
+            t.Fatalf("%v: message %v has role %q, expected %q", what, index, message.Role, expectedRole)
+        }
+    }
+
+    if endsWithUser != (len(messages) % 2 == 1) {
+        t.Fatalf("%v: %v messages, expected the last one to be a %v message", what, len(messages),
+                 map[bool]string{true: "user", false: "assistant"}[endsWithUser])
+    }
+}
+
+// This test sends queries to a backend that fails some of them, and checks that the conversation
+// history, the stored history, and every request sent to the AI keep alternating between user and
+// assistant messages, with no trace of the failed exchanges.
+func TestHistoryAlternationWithFailures(t *testing.T) {
+    jsonlStore, err := newJSONLHistoryStore(t.TempDir())
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    stores := map[string]HistoryStore{"memory": newMemoryHistoryStore(), "jsonl": jsonlStore}
+
+    for storeName, store := range stores {
+        t.Run(storeName, func(t *testing.T) {
+            savedStore := historyStore
+            historyStore = store
+            t.Cleanup(func() { historyStore = savedStore })
+
+            // Fail two of every five requests, including some in a row.
+            backend := &flakyBackend{fail: func(call int) bool { return call % 5 == 2 || call % 5 == 3 }}
+
+            cfg := defaultConfig()
+            cfg.History.Summarize = false
+            cfg.History.MaxMessages = 6
+            cfg.AI.ShowSources = false
+            cfg.backend = backend
+
+            convKey := "ch:alternation-" + storeName
+            successes := 0
+
+            for index := range 20 {
+                question := fmt.Sprintf("question %v", index)
+                query := &Query{UserID: "1", Nick: "Tester", ConvKey: convKey, Text: question}
+
+                // Exercise both the streaming and the non-streaming paths.
+                var onProgress func(partialResponse string)
+
+                if index % 2 == 0 {
+                    onProgress = func(partialResponse string) {}
+                }
+
+                answer := getAIResponse(context.Background(), cfg, query, onProgress, nil)
+                failed := strings.Contains(answer, "529 Overloaded")
+
+                recentMessagesMu.Lock()
+                history := historyListToSlice(historyGetList(cfg, convKey))
+                recentMessagesMu.Unlock()
+
+                checkAlternation(t, fmt.Sprintf("history after %v", question), history, false)
+
+                stored, err := historyStore.Load(convKey)
+
+                if err != nil {
+                    t.Fatal(err)
+                }
+
+                checkAlternation(t, fmt.Sprintf("stored history after %v", question), stored, false)
+
+                // The newest exchange is the last one that succeeded.
+                newestQuestion := ""
+
+                if len(history) >= 2 {
+                    newestQuestion = history[len(history)-2].text()
+                }
+
+                if failed && newestQuestion == question {
+                    t.Fatalf("failed %v was saved in the history", question)
+                }
+
+                if !failed {
+                    successes++
+
+                    if newestQuestion != question {
+                        t.Fatalf("%v was answered, but the newest question in the history is %q", question,
+                                 newestQuestion)
+                    }
+                }
+            }
+
+            if successes == 0 || successes == backend.calls {
+                t.Fatalf("%v of %v requests succeeded, expected some failures and some successes", successes,
+                         backend.calls)
+            }
+
+            for index, messages := range backend.requests {
+                checkAlternation(t, fmt.Sprintf("request %v", index+1), messages, true)
+            }
+        })
+    }
+}
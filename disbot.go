@@ -1,20 +1,17 @@
 package main
 
 import (
-    "bytes"
     "container/list"
-    "encoding/json"
+    "context"
     "fmt"
-    "net/http"
     "log"
     "os"
     "os/signal"
     "path/filepath"
-    "math"
     "math/rand"
     "strings"
     "strconv"
-    "sync"
+    "syscall"
     "time"
 
     "github.com/bwmarrin/discordgo"
@@ -24,109 +21,150 @@ import (
 type List = list.List
 
 // Package scope constants.
-const DEFAULT_MAX_RECENT_MESSAGES = 10
+const (
+    // By default, conversation history is limited only by its size in tokens.
+    DEFAULT_MAX_RECENT_MESSAGES = 0
+
+    // The default number of tokens each request to the AI may use, including the system prompt,
+    // the conversation history, and the AI's output.
+    DEFAULT_CONTEXT_TOKENS = 8192
+
+    // When the bot shuts down, how long it waits for canceled queries to tell their users, after
+    // the grace period for answering them is over.
+    SHUTDOWN_CANCEL_WAIT = 10 * time.Second
+)
 
 // Package scope variables.
 var (
     // The base name of this executeable (e.g., 'disbot').
     Me = strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
 
-    // The AI's API key.  This is set from an environment variable.
-    apiKey = ""
-
     // The bot's Discord authentication token.  This is set from an environment variable.
     botToken = ""
 
     // The time this bot started.  used in status messages.
     startTime = time.Now()
 
-    // Per-conversation timestamps of the last message received. Used to throttle responses
-    // so that one user's messages don't block other conversations.
-    lastMessageAt  = make(map[string]time.Time)
-    lastMessageMu  sync.Mutex
-
-    // This is true if Web search is enable in the query to the AI.  Override this with switch
-    // --nosearch.
-    webSearchEnabled = true
-
-    // This is true if reasoning is enabled in the query to the AI.  Override this with switch
-    // --nothink.
-    reasoningEnabled = true
-
-    // The 'max_tokens' value sent in each AI request.
-    maxTokens = 2048
-
-    // When reasoningEnabled is true, this is the reasoning 'budget_tokens' value send in each AI
-    // request.  If this is smaller than 1024, Claude's API fails with HTTP error 400 (Bad Request).
-    thinkingMaxTokens = 1024
-
-    // When webSearchEnabled is true, is the 'max_uses' value send in the Web search tool definition
-    // in each AI request.
-    maxWebSearches = 1
-
-    // The maximum number of messages to save in each channel's or user's conversation history
-    // (incuding the AI's messages).  Must be an even number, because each conversation history
-    // should contain pairs of user/AI messages.  Switch --history overrides the default value of
-    // this variable.
-    maxRecentMessages = DEFAULT_MAX_RECENT_MESSAGES
+    // Returns the current time.  The rate limits and quotas use this, so that tests can replace it.
+    clock = time.Now
 )
 
 // Display usage and terminate.
 func usage() {
-    msg := "usage: " + Me + " [ --search ] [ --think ] [ --history N ]\n\n" +
-           "--nosearch   =>  Disable Web searching in the AI.\n" +
-           "--nothink    =>  Disable reasoning in the AI.\n" +
-           "--history N  =>  Keep N most recent user/AI messages (default: %v).\n" +
-           "                 (N must be an even integer.)\n"
-
-    fmt.Printf(msg, DEFAULT_MAX_RECENT_MESSAGES)
+    msg := "usage: " + Me + " [ --config FILE ] [ --nosearch ] [ --nothink ] [ --nostream ]\n" +
+           "              [ --history N ] [ --context-tokens N ] [ --backend NAME ] [ --model NAME ]\n" +
+           "              [ --base-url URL ] [ --data-dir DIR ] [ --nosummary ]\n" +
+           "              [ --summary-model NAME ]\n\n" +
+           "--config FILE         =>  Read settings from YAML file FILE.  See disbot.example.yaml for\n" +
+           "                          the available settings.  The other switches override the\n" +
+           "                          settings in FILE.  Send SIGHUP to reload FILE.\n" +
+           "--nosearch            =>  Disable Web searching in the AI.\n" +
+           "--nothink             =>  Disable reasoning in the AI.\n" +
+           "--nostream            =>  Disable streaming responses into Discord as they are generated.\n" +
+           "--history N           =>  Keep at most N most recent user/AI messages (default: no limit\n" +
+           "                          other than --context-tokens).  (N must be an even integer.)\n" +
+           "--context-tokens N    =>  Limit each AI request to about N tokens, including the system\n" +
+           "                          prompt, conversation history, and AI output.  Older history is\n" +
+           "                          dropped to fit (default: %v).\n" +
+           "--backend NAME        =>  Use AI backend NAME (default: anthropic).  Supported backends:\n" +
+           "                          anthropic  =>  Anthropic's Messages API (needs ANTHROPIC_API_KEY).\n" +
+           "                          openai     =>  Any OpenAI-compatible chat completions API (uses\n" +
+           "                                         OPENAI_API_KEY if set).\n" +
+           "--model NAME          =>  Use AI model NAME (default: the backend's default model).\n" +
+           "--base-url URL        =>  Send AI requests to the API at URL (default: the backend's\n" +
+           "                          default URL, e.g., 'https://api.openai.com/v1').\n" +
+           "--data-dir DIR        =>  Keep conversation histories in directory DIR, so they survive\n" +
+           "                          restarts (default: keep them in memory only).\n" +
+           "--nosummary           =>  Disable summarizing conversation history that no longer fits in\n" +
+           "                          the history window.  (By default, it's summarized by the AI and\n" +
+           "                          the summary is sent with each request.)\n" +
+           "--summary-model NAME  =>  Use AI model NAME to summarize conversation history (default:\n" +
+           "                          '%v' for the anthropic backend, otherwise the\n" +
+           "                          backend's default model).\n"
+
+    fmt.Printf(msg, DEFAULT_CONTEXT_TOKENS, DEFAULT_ANTHROPIC_SUMMARY_MODEL)
     os.Exit(1)
 }
 
-// Package initialization.
-func init() {
-    // Get the AI API key from an environment variable.
-    apiKey = os.Getenv("ANTHROPIC_API_KEY")
-
-    if apiKey == "" {
-        fmt.Println("Error: Environment variable ANTHROPIC_API_KEY not set.")
-        os.Exit(1)
-    }
+func main() {
+    // Parse the command-line switches.  This will set configPath and commandLineOverrides based on
+    // the command-line switches (or show usage and terminate in the case of erroneous usage).
+    parseCommandLine()
 
-    // Get the bot's authentication token from an environment variable.
+    // Get the bot's authentication token from an environment variable.  This is checked here
+    // rather than in an init function, so that the tests can run without it.
     botToken = os.Getenv("DISCORD_BOT_TOKEN")
 
     if botToken == "" {
         fmt.Printf("%v: Environment variable DISCORD_BOT_TOKEN is not set!\n", Me)
         os.Exit(1)
     }
-}
 
-func main() {
-    // Parse the command-line switches.  This will set various package-scope variables based on the
-    // command-line switches (or show usage and terminate in the case of erroneous usage).
-    parseCommandLine()
+    // Build and validate the configuration from the configuration file and command-line switches,
+    // and create the AI backend.
+    config, err := loadConfiguration()
+
+    if err != nil {
+        fmt.Printf("%v: Error: %v\n", Me, err)
+        os.Exit(1)
+    }
+
+    activeConfig.Store(config)
 
-    if reasoningEnabled {
+    // Keep conversation histories and token usage on disk if a data directory was given.
+    if config.DataDir != "" {
+        historyStore, err = newJSONLHistoryStore(filepath.Join(config.DataDir, "history"))
+
+        if err != nil {
+            fmt.Printf("%v: Error: %v\n", Me, err)
+            os.Exit(1)
+        }
+
+        usageLedger, err = openUsageLedger(filepath.Join(config.DataDir, "usage.jsonl"))
+
+        if err != nil {
+            fmt.Printf("%v: Error: %v\n", Me, err)
+            os.Exit(1)
+        }
+
+        fmt.Printf("Conversation histories and token usage are kept in %v.\n", config.DataDir)
+    }
+
+    if config.reasoningEnabled() {
         fmt.Println("Reasoning is enabled.")
     }
 
-    if webSearchEnabled {
+    if config.webSearchEnabled() {
         fmt.Println("Web search is enabled.")
     }
 
+    // Answer queries with up to the configured number of requests to the AI at once.
+    queryDispatcher = newDispatcher(config.Dispatch.MaxConcurrent)
+
     // Create a new Discord session using the bot token.
     dg, err := discordgo.New("Bot " + botToken)
     if err != nil {
         log.Fatalf("Error creating Discord session: %v", err)
     }
 
-    // Register the handleMessageCreateEvent func as a callback for MessageCreate events.
+    // Register the handleMessageCreateEvent func as a callback for MessageCreate events, and the
+    // handleInteractionCreateEvent func as a callback for slash commands.
     dg.AddHandler(handleMessageCreateEvent)
+    dg.AddHandler(handleInteractionCreateEvent)
 
-    // In this example, we only care about receiving message events from channels (aka guilds) and
-    // from DMs.
-    dg.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages
+    // Register callbacks that forget the history of threads that are archived or deleted.
+    dg.AddHandler(handleThreadUpdateEvent)
+    dg.AddHandler(handleThreadDeleteEvent)
+
+    // Register callbacks that cancel queries whose messages are deleted or get a CANCEL_EMOJI
+    // reaction.
+    dg.AddHandler(handleMessageDeleteEvent)
+    dg.AddHandler(handleMessageReactionAddEvent)
+
+    // We only care about receiving message and reaction events from channels (aka guilds) and from
+    // DMs, and thread events (which are part of the guilds intent).
+    dg.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages |
+                          discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessageReactions
 
     // Open a websocket connection to Discord and begin listening.
     err = dg.Open()
@@ -134,23 +172,117 @@ func main() {
         log.Fatalf("Error opening connection: %v", err)
     }
 
+    // Register the slash commands.  The bot still works without them, so this isn't fatal.
+    err = registerSlashCommands(config, dg)
+
+    if err != nil {
+        fmt.Printf("%v: Error: %v\n", Me, err)
+    } else if config.Discord.SlashCommands.Enabled {
+        fmt.Printf("Slash commands are registered (%v).\n", config.Discord.SlashCommands.Scope)
+    }
+
     fmt.Println("Bot is running.  Press Ctrl-C to exit.")
 
-    // Wait here until Ctrl-C or other term signal is received.
+    // Wait here until Ctrl-C or SIGTERM (which is what systemd and container runtimes send) is
+    // received.  SIGHUP reloads the configuration file without closing the Discord session.
     sc := make(chan os.Signal, 1)
-    signal.Notify(sc, os.Interrupt)
-    <-sc
+    signal.Notify(sc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+    for sig := range sc {
+        if sig != syscall.SIGHUP {
+            break
+        }
+
+        if err := reloadConfiguration(); err != nil {
+            fmt.Printf("%v: Error reloading configuration: %v\n", Me, err)
+        }
+    }
 
-    // Cleanly close down the Discord session.
-    dg.Close()
+    shutdown(dg, sc)
 }
 
-// This function parses the command-line arguments and sets various package-scope variables based on
-// those switches.  If the command-line arguments are invalid, it shows usage and exits the program.
+// This function shuts the bot down gracefully.  It stops accepting queries, and waits for the
+// queries that are being answered or waiting to be answered, and the summaries being written, for
+// up to the dispatch.shutdown_grace_period setting.  Then it cancels the queries that are left
+// (whose users are told why), saves the conversation histories and token usage to disk, and closes
+// session.  Another signal on signals ends the grace period early.
+func shutdown(session *discordgo.Session, signals chan os.Signal) {
+    cfg := currentConfig()
+
+    fmt.Printf("Shutting down.  Waiting up to %v for answers in progress (press Ctrl-C again to stop " +
+               "waiting) ...\n", cfg.Dispatch.ShutdownGracePeriod)
+
+    graceCtx, cancel := context.WithTimeout(context.Background(), cfg.Dispatch.ShutdownGracePeriod)
+    defer cancel()
+
+    go func() {
+        for sig := range signals {
+            if sig != syscall.SIGHUP {
+                cancel()
+            }
+        }
+    }()
+
+    // Wait for the queries, then for the summaries of the history that their answers pushed out of
+    // the history window.
+    if !queryDispatcher.Drain(graceCtx) {
+        fmt.Printf("%v: shutdown: Canceling the answers still in progress.\n", Me)
+        queryDispatcher.Shutdown()
+
+        cancelCtx, cancelWait := context.WithTimeout(context.Background(), SHUTDOWN_CANCEL_WAIT)
+        defer cancelWait()
+
+        queryDispatcher.Drain(cancelCtx)
+    }
+
+    if !waitGroupWait(graceCtx, &pendingSummaries) {
+        fmt.Printf("%v: shutdown: Giving up on the conversation summaries still being written.\n", Me)
+    }
+
+    if err := historyStore.Flush(); err != nil {
+        fmt.Printf("%v: shutdown: Error saving conversation histories: %v\n", Me, err)
+    }
+
+    if err := usageLedger.Flush(); err != nil {
+        fmt.Printf("%v: shutdown: Error saving token usage: %v\n", Me, err)
+    }
+
+    session.Close()
+    fmt.Println("Bot has shut down.")
+}
+
+// This function parses the command-line arguments.  It sets configPath from switch --config and
+// appends a function to commandLineOverrides for each other switch, which loadConfiguration uses
+// to override the settings in the configuration file.  If the command-line arguments are invalid,
+// it shows usage and exits the program.
 func parseCommandLine() {
-    if len(os.Args) > 3 {
-        fmt.Println("Too many parameters!\n")
-        usage()
+    // This returns the parameter of the switch at os.Args[index], which is the next argument.  If
+    // there is no next argument, it shows usage and exits.
+    switchParameter := func(index int) string {
+        if index+1 >= len(os.Args) {
+            fmt.Printf("%v: Missing parameter for switch '%v'!\n\n", Me, os.Args[index])
+            usage()
+        }
+
+        return os.Args[index+1]
+    }
+
+    // This returns the parameter of the switch at os.Args[index] as a positive integer.  If it
+    // isn't one, it shows usage and exits.
+    positiveSwitchParameter := func(index int) int {
+        value, err := strconv.Atoi(switchParameter(index))
+
+        if err != nil || value <= 0 {
+            fmt.Printf("%v: Invalid parameter for switch '%v': '%v'!\n\n", Me, os.Args[index], os.Args[index+1])
+            usage()
+        }
+
+        return value
+    }
+
+    // This records a function that applies a switch to the configuration.
+    override := func(apply func(cfg *Config)) {
+        commandLineOverrides = append(commandLineOverrides, apply)
     }
 
     // Check for command-line switches.
@@ -158,13 +290,26 @@ func parseCommandLine() {
         argument := os.Args[index]
 
         switch argument {
+        case "--config":
+            // Read settings from a configuration file.
+            configPath = switchParameter(index)
+            index++
+
         case "--nosearch":
             // Disable Web searching in the AI.
-            webSearchEnabled = false
+            override(func(cfg *Config) { cfg.AI.WebSearch = false })
 
         case "--nothink":
             // Disable reasoning in the AI.
-            reasoningEnabled = false
+            override(func(cfg *Config) { cfg.AI.Reasoning = false })
+
+        case "--nosummary":
+            // Disable summarization of conversation history.
+            override(func(cfg *Config) { cfg.History.Summarize = false })
+
+        case "--nostream":
+            // Disable streaming of AI responses.
+            override(func(cfg *Config) { cfg.AI.Streaming = false })
 
         case "--help", "-h":
             // Show usage and exit.
@@ -172,25 +317,39 @@ func parseCommandLine() {
 
         case "--history":
             // Set the maximum number of recent messages to keep.
-            index++ // Advance to the next argument, which should be the number of messages to keep.
+            maxMessages := positiveSwitchParameter(index)
+            index++
 
-            if index >= len(os.Args) {
-                fmt.Printf("%v: Missing parameter for switch '%v'!\n\n", Me, argument)
+            if maxMessages % 2 != 0 {
+                fmt.Printf("%v: The value for switch '%v' must be an even number!\n\n", Me, argument)
                 usage()
             }
 
-            // Get the number of messages to keep.
-            var err error
-            maxRecentMessages, err = strconv.Atoi(os.Args[index])
-
-            if err != nil || maxRecentMessages <= 0 {
-                fmt.Printf("%v: Invalid parameter for switch '%v': '%v'!\n\n", Me, argument, os.Args[index])
-                usage()
-            }
-
-            if maxRecentMessages % 2 != 0 {
-                fmt.Printf("%v: The value for switch '%v' must be an even number!\n\n", Me, argument)
-                usage()
+            override(func(cfg *Config) { cfg.History.MaxMessages = maxMessages })
+
+        case "--context-tokens":
+            // Set the token budget for each request to the AI.
+            contextTokens := positiveSwitchParameter(index)
+            index++
+
+            override(func(cfg *Config) { cfg.History.ContextTokens = contextTokens })
+
+        case "--backend", "--model", "--base-url", "--data-dir", "--summary-model":
+            // Set the AI backend, model, base URL, data directory, or summary model.
+            parameter := switchParameter(index)
+            index++
+
+            switch argument {
+            case "--backend":
+                override(func(cfg *Config) { cfg.AI.Backend = parameter })
+            case "--model":
+                override(func(cfg *Config) { cfg.AI.Model = parameter })
+            case "--data-dir":
+                override(func(cfg *Config) { cfg.DataDir = parameter })
+            case "--summary-model":
+                override(func(cfg *Config) { cfg.History.SummaryModel = parameter })
+            default:
+                override(func(cfg *Config) { cfg.AI.BaseURL = parameter })
             }
 
         default:
@@ -203,110 +362,253 @@ func parseCommandLine() {
 // This function will be called (due to AddHandler) every time a new message is seen by this bot in
 // any channel or DM.
 func handleMessageCreateEvent(session *discordgo.Session, messageCreateEvent *discordgo.MessageCreate) {
-    // Ignore all messages created by the bot itself
-    if messageCreateEvent.Author.ID == session.State.User.ID {
+    // Ignore all messages created by the bot itself, and by other bots, so that bots that mention
+    // or reply to each other can't get stuck in a loop.
+    botID := session.State.User.ID
+
+    if messageCreateEvent.Author.ID == botID || messageCreateEvent.Author.Bot {
         return
     }
 
     // Strip leading and trailing whitespace from the message.
     userMessage := strings.TrimSpace(messageCreateEvent.Content)
 
-    // Ignore empty messages and messages that don't start with the command prefix.
-    if len(userMessage) == 0 || !strings.HasPrefix(userMessage, "!") {
+    // Ignore empty messages.  A message with attachments but no text isn't empty.
+    if len(userMessage) == 0 && len(messageCreateEvent.Attachments) == 0 {
         return
     }
 
-    // Break the message string into words and extract the command word.
-    messageParts := strings.Fields(userMessage)
-    command := strings.ToLower(messageParts[0])
+    // Get the active configuration.  Everything done in response to this message uses this
+    // snapshot, even if the configuration is reloaded before we're done.
+    cfg := currentConfig()
 
     // Get the channel ID that will be used to send messages to the channel.  This is NOT the
     // channel name.
     channelID := messageCreateEvent.ChannelID
 
-    switch command {
-    case "!help":
-        // Display the help message.
-        sendHelpMessage(session, channelID)
+    // Replies are posted as ordinary messages in the same channel/DM.
+    responder := newChannelResponder(session, channelID)
+
+    // This will hold the text to send to the AI.
+    var query string
+
+    if strings.HasPrefix(userMessage, "!") {
+        // Break the message string into words and extract the command word.
+        messageParts := strings.Fields(userMessage)
+        command := strings.ToLower(messageParts[0])
+
+        switch command {
+        case "!help":
+            // Display the help message.
+            sendHelpMessage(cfg, responder)
+            return
+
+        case "!status":
+            // Display the status message.
+            sendStatusMessage(cfg, responder)
+            return
+
+        case "!!say":
+            // Process the '!!say ...' command.
+            handleSayCommand(cfg, session, responder, messageCreateEvent, messageParts)
+            return
+
+        case "!!reload":
+            // Process the '!!reload' command.
+            handleReloadCommand(cfg, responder, messageCreateEvent.Author.ID, command)
+            return
+
+        case "!usage":
+            // Display token usage and cost.
+            sendUsageMessage(responder, usageCommandArgument(messageParts), messageCreateEvent.Author.ID, channelID)
+            return
+
+        case "!!usage":
+            // Only the bot's owner can see everyone's usage.
+            if checkOwner(cfg, responder, messageCreateEvent.Author.ID, command) {
+                sendUsageBreakdownMessage(responder, usageCommandArgument(messageParts))
+            }
+            return
+        }
+
+        // For all other uses of '!...', send the message (without the '!') to the AI.
+        query = strings.TrimPrefix(userMessage, "!")
+    } else if isTriggered(cfg, messageCreateEvent, botID) {
+        // The message mentions the bot, replies to the bot, or is a DM.  Send it to the AI without
+        // the mention, which means nothing to the AI.
+        query = stripMention(userMessage, botID)
+
+        if query == "" && len(messageCreateEvent.Attachments) == 0 {
+            // Someone mentioned the bot without saying anything else.
+            sendHelpMessage(cfg, responder)
+            return
+        }
+    } else {
+        // Ignore all other messages.
+        return
+    }
 
-    case "!status":
-        // Display the status message.
-        sendStatusMessage(session, channelID)
+    // Send the query to the AI to generate a reply and then send it to the channel/DM.
 
-    case "!!say":
-        // Process the '!!say ...' command.
-        handleSayCommand(session, messageCreateEvent, messageParts)
+    // First, get the channel where the message was received by this bot and the nick of the user
+    // who sent the message. If the message is a DM, the channel name is the empty string. If
+    // either name is unavailable, it will be "unknown".
+    channel, nick := getChannelAndNick(session, messageCreateEvent)
 
-    default:
-        // For all other uses of '!...', send the message to the AI to generate a reply and then
-        // send it to the channel/DM .
+    // Compute the conversation key used to store history and rate-limit state.
+    convKey := conversationKey(channel, messageCreateEvent.Author.ID)
 
-        // First, get the name of the channel where the message was received by this bot, the
-        // nick of the user who sent the message, and whether it's a DM. If the message is a DM,
-        // the channel name is the empty string. If either name is unavailable, it will be "unknown".
-        channelName, nick, isDM := getChannelAndNick(session, messageCreateEvent)
+    // If the message is a reply, the AI also gets the message being replied to.  If the message
+    // is the first one the bot sees in a thread, the AI also gets the message that started the
+    // thread.
+    quotedContext := getReplyContext(cfg, session, messageCreateEvent.Message, botID)
 
-        // Compute the conversation key used to store history and rate-limit state.
-        convKey := conversationKey(channelID, messageCreateEvent.Author.ID, isDM)
+    if channel.IsThread() && cfg.Discord.Threads.SeedFromStarter && historyLength(cfg, convKey) == 0 {
+        starterContext := getThreadStarterContext(session, channel, messageCreateEvent.ID, botID)
 
-        // Generate the response and send it.
-        sendAIGeneratedResponse(session, channelID, channelName, nick, convKey, userMessage)
+        if starterContext != "" && quotedContext != "" {
+            quotedContext = starterContext + "\n" + quotedContext
+        } else if starterContext != "" {
+            quotedContext = starterContext
+        }
     }
+
+    // Generate the response and send it.
+    sendAIGeneratedResponse(cfg, session, responder, &Query{
+        ChannelName:   channel.Name,
+        GuildID:       messageCreateEvent.GuildID,
+        ChannelID:     channelID,
+        MessageID:     messageCreateEvent.ID,
+        ThreadAllowed: canStartThread(channel),
+        UserID:        messageCreateEvent.Author.ID,
+        Nick:          nick,
+        RoleIDs:       memberRoles(messageCreateEvent.Member),
+        ConvKey:       convKey,
+        Text:          query,
+        QuotedContext: quotedContext,
+        Attachments:   messageCreateEvent.Attachments,
+    })
 }
 
-// This function returns the name of the channel where the message was sent, the nick of the user
-// who sent the message, and whether the message is a DM. If the message is a DM, the channel
-// name is the empty string and isDM is true. If either name is unavailable due to an error, it
-// is returned as "unknown" and an error is written to stdout.
-func getChannelAndNick(session *discordgo.Session, messageCreateEvent *discordgo.MessageCreate) (string, string, bool) {
+// This function returns the channel where the message was sent and the nick of the user who sent
+// the message. If the message is a DM, the channel name is the empty string. If either is
+// unavailable due to an error, the name is "unknown" and an error is written to stdout.
+func getChannelAndNick(session *discordgo.Session, messageCreateEvent *discordgo.MessageCreate) (*discordgo.Channel, string) {
     // Get the channel the message was sent from.
-    var channelName string
-    var isDM bool
+    channel := getChannel(session, messageCreateEvent.ChannelID)
 
-    channel, err := session.Channel(messageCreateEvent.ChannelID)
+    // Get the nick of the Discord user who sent the message.
+    if messageCreateEvent.Author == nil {
+        // We don't know the nick of the user who sent this message.
+        fmt.Println("messageCreateEvent.Author = nil")
+        return channel, "unknown"
+    }
+
+    return channel, getNick(messageCreateEvent.Member, messageCreateEvent.Author)
+}
+
+// This function returns the channel identified by channelID.  In a DM, the channel name is the
+// empty string.  If the channel is unavailable due to an error, this returns a server text channel
+// named "unknown" and writes an error to stdout.
+func getChannel(session *discordgo.Session, channelID string) *discordgo.Channel {
+    channel, err := session.Channel(channelID)
 
     if err != nil {
         // We don't know which channel this message was sent from.
-        fmt.Printf("%v: getChannelAndNick: Error getting channel name: %v\n", Me, err)
-        channelName = "unknown"
-    } else {
-        channelName = channel.Name // In a DM, this is the empty string.
-        isDM = (channel.Type == discordgo.ChannelTypeDM || channel.Type == discordgo.ChannelTypeGroupDM)
+        fmt.Printf("%v: getChannel: Error getting channel: %v\n", Me, err)
+        return &discordgo.Channel{ID: channelID, Name: "unknown", Type: discordgo.ChannelTypeGuildText}
     }
 
-    // Get the nick of the Discord user who sent the message.
-    var nick string
+    return channel
+}
 
-    if messageCreateEvent.Author == nil || messageCreateEvent.Author.GlobalName == "" {
-        // We don't know the nick of the user who sent this message.
-        fmt.Println("messageCreateEvent.Author = nil")
-        nick = "unknown"
-    } else {
-        nick = messageCreateEvent.Author.GlobalName
+// This function returns the IDs of the server roles of member, or nil if member is nil (i.e., in
+// a DM).
+func memberRoles(member *discordgo.Member) []string {
+    if member == nil {
+        return nil
     }
 
-    return channelName, nick, isDM
+    return member.Roles
+}
+
+// This function returns true if channel is a DM.
+func isDMChannel(channel *discordgo.Channel) bool {
+    return channel.Type == discordgo.ChannelTypeDM || channel.Type == discordgo.ChannelTypeGroupDM
 }
 
-// This function sends the help message to the channel/DM where messageCreateEvent came from.
-func sendHelpMessage(session *discordgo.Session, channelID string) {
+// This function returns the nick of user.  This is the user's nickname in the server, if they have
+// one, otherwise their display name, otherwise their username.  member is the user's membership
+// in the server, which is nil in a DM.
+func getNick(member *discordgo.Member, user *discordgo.User) string {
+    if member != nil && member.Nick != "" {
+        return member.Nick
+    } else if user.GlobalName != "" {
+        return user.GlobalName
+    } else {
+        return user.Username
+    }
+}
+
+// This function sends the help message with responder.  The message describes the ways of talking
+// to the bot that are enabled in cfg.
+func sendHelpMessage(cfg *Config, responder Responder) {
+    triggers := cfg.Discord.Triggers
+
+    var otherWays []string
+
+    if triggers.Mention {
+        otherWays = append(otherWays, "mention me")
+    }
+
+    if triggers.Reply {
+        otherWays = append(otherWays, "reply to one of my messages")
+    }
+
+    howToTalk := "Talk to me with the `/ask` command, or by starting your message with '`!`'"
+
+    if len(otherWays) > 0 {
+        howToTalk += ", or " + strings.Join(otherWays, ", or ")
+    }
+
+    var dmHelp string
+
+    if triggers.DM {
+        dmHelp = "You can also DM me, and then you don't need the '`!`' prefix. "
+    } else {
+        dmHelp = "You can also DM me, but you must use `/ask` or the '`!`' prefix even in DMs. "
+    }
+
     helpMsg := "I'm a bot written in Go by Fran, Gemini, and Claude.  My responses are generated by Claude. " +
-               "Talk to me by starting your message with '`!`'. For example:\n\n" +
+               howToTalk + ". For example:\n\n" +
                "• `!What is the mass of Jupiter?`\n" +
                "• `!What was the title of the Grateful Dead's second studio album?`\n" +
-               "• `!What was George Orwell's real name?`\n\n" +
-               "You can also DM me, but you must use the '`!`' prefix even in DMs. My replies will " +
-               "be brief, because tokens cost money. I don't know your Discord usernames. All of you " +
-               "appear to me as a single user. I have no memory of your previous messages to me (yet). " +
+               "• `/ask question: What was George Orwell's real name?`\n\n" +
+               dmHelp + "My replies will " +
+               "be brief, because tokens cost money. I know who said what, so several of you can talk " +
+               "to me in the same conversation, and I remember our recent conversation. To cancel a " +
+               "message I haven't answered yet, delete it or react to it with " + CANCEL_EMOJI + ". " +
                "I also respond to these commands:\n\n" +
-               "• `!status` - Shows my status and uptime.\n" +
-               "• `!help`   - Shows this help message."
+               "• `/status` or `!status` - Shows my status and uptime.\n" +
+               "• `/usage` or `!usage [ me | channel | today | month ]` - Shows how many tokens have " +
+               "been used and what they cost.\n" +
+               "• `/help` or `!help`     - Shows this help message."
 
-    session.ChannelMessageSend(channelID, helpMsg)
+    sendLongMessage(responder, helpMsg)
 }
 
-// This function sends a status message to the channel/DM where messageCreateEvent came from.
-func sendStatusMessage(session *discordgo.Session, channelID string) {
+// This function returns the argument of a '!usage' or '!!usage' command whose words are
+// messageParts, in lower case, or the empty string if there is none.
+func usageCommandArgument(messageParts []string) string {
+    if len(messageParts) < 2 {
+        return ""
+    }
+
+    return strings.ToLower(messageParts[1])
+}
+
+// This function sends a status message with responder.
+func sendStatusMessage(cfg *Config, responder Responder) {
     states := []string{"nominal", "behaving", "rocking it", "within reason", "pretty good", "being real",
                        "killing it", "grooving", "just peachy", "okey dokey", "fine, just fine",
                        "... oh never mind", "reasonable", "adequate", "plausible", "howling", "meh",
@@ -316,30 +618,28 @@ func sendStatusMessage(session *discordgo.Session, channelID string) {
 
     msg := fmt.Sprintf("All systems are %v.  I have been running for %v.", state, uptime.Round(time.Second))
 
-    if webSearchEnabled {
+    if cfg.webSearchEnabled() {
         msg += " Web searching is enabled."
     }
 
-    if reasoningEnabled {
+    if cfg.reasoningEnabled() {
         msg += " Extended thinking is enabled."
     }
 
-    session.ChannelMessageSend(channelID, msg)
+    sendLongMessage(responder, msg)
 }
 
 // This function handles the '!!say CHANNEL MESSAGE' command.
-func handleSayCommand(session *discordgo.Session, messageCreateEvent *discordgo.MessageCreate,
-                      messageParts []string) {
-    // Only Fran can use the '!!say' command.
-    if messageCreateEvent.Author.ID != "555030984706359296" {
-        msg := "Sorry, only Fran can use the '!!say' command."
-        session.ChannelMessageSend(messageCreateEvent.ChannelID, msg)
+func handleSayCommand(cfg *Config, session *discordgo.Session, responder Responder,
+                      messageCreateEvent *discordgo.MessageCreate, messageParts []string) {
+    // Only the bot's owner can use the '!!say' command.
+    if !checkOwner(cfg, responder, messageCreateEvent.Author.ID, "!!say") {
         return
     }
 
     if len(messageParts) < 3 {
         msg := "Too few parameters.  Usage: `!!say CHANNELNAME MESSAGE`"
-        session.ChannelMessageSend(messageCreateEvent.ChannelID, msg)
+        responder.Send(msg)
         return
     }
 
@@ -352,379 +652,66 @@ func handleSayCommand(session *discordgo.Session, messageCreateEvent *discordgo.
     // Remove the channel name and leading/trailing whitespace from message.
     message = strings.TrimSpace(strings.TrimPrefix(message, channelName))
 
-    // Add a prefix saying this message is from Fran.
-    message = "Fran asked me to say this: " + message
+    sayInChannel(cfg, session, responder, channelName, message)
+}
+
+// This function sends message to the channel named channelName on behalf of the bot's owner, and
+// reports the outcome with responder.  This implements the '!!say' and '/say' commands.
+func sayInChannel(cfg *Config, session *discordgo.Session, responder Responder, channelName string,
+                  message string) {
+    // Add a prefix saying this message is from the bot's owner.
+    message = cfg.Discord.OwnerName + " asked me to say this: " + message
 
     // Send the message to the specified channel.
-    errMsg := sendMessageToChannel(session, channelName, message)
+    errMsg := sendMessageToChannel(cfg, session, channelName, message)
 
-    // Report status to the user to issued the '!!say ...' command.
+    // Report status to the user to issued the command.
     if errMsg != "" {
-        // There was an error sending the message.  Send the error message to the channel where
-        // the command was issued.
-        session.ChannelMessageSend(messageCreateEvent.ChannelID, errMsg)
+        // There was an error sending the message.  Send the error message to the user who issued
+        // the command.
+        responder.Send(errMsg)
     } else {
         // The message was sent successfully, so send a confirmation message.
         msg := fmt.Sprintf("Message sent to channel '%v'.", channelName)
-        session.ChannelMessageSend(messageCreateEvent.ChannelID, msg)
+        responder.Send(msg)
     }
 }
 
-// TODO: Move all AI-related functions to new source file ai.go.
-
-// =============================================================================
-// UNDER CONSTRUCTION
-// =============================================================================
-
-// This function sends a message generated by the AI backend in response to the user's message.
-func sendAIGeneratedResponse(session *discordgo.Session, channelID string, channelName string,
-                             nick string, convKey string, userMessage string) {
-    // Remove the leading '!' from messageCreateEvent.Content.
-    userMessage = strings.TrimPrefix(userMessage, "!")
-
-    // Complain if userMessage is too long.
-    maxUserMessageChars := 1000
-
-    if len(userMessage) > maxUserMessageChars {
-        msg := fmt.Sprintf("Sorry, I can't respond to messages that are longer than %v characters.",
-                           maxUserMessageChars)
-        session.ChannelMessageSend(channelID, msg)
+// This function handles the '!!reload' and '/reload' commands, which re-read the configuration
+// file.  userID identifies the user who issued the command, which is named command.
+func handleReloadCommand(cfg *Config, responder Responder, userID string, command string) {
+    // Only the bot's owner can reload the configuration.
+    if !checkOwner(cfg, responder, userID, command) {
         return
     }
 
-    // Remember the time of this message, so we can throttle replies if messages arrive too quickly.
-    thisMessageTime := time.Now()
-
-    // Check per-conversation rate limiting so that one user's messages don't throttle everyone.
-    minSecondsBetweenMessages := (10 * time.Second).Seconds()
-
-    lastMessageMu.Lock()
-    prevTime := lastMessageAt[convKey]
-    lastMessageMu.Unlock()
-
-    secondsSinceLastMessage := time.Since(prevTime).Seconds()
-    secondsUntilMessagesAllowed := math.Round(minSecondsBetweenMessages - secondsSinceLastMessage + 0.5)
-
-    if !prevTime.IsZero() && secondsSinceLastMessage < minSecondsBetweenMessages {
-        // Too little time has passed since the previous message in this conversation.
-        msg := fmt.Sprintf("Sorry, I'm overloaded. Please wait %v seconds before talking to me.",
-                           secondsUntilMessagesAllowed)
-        session.ChannelMessageSend(channelID, msg)
-    } else {
-        // Generate a response from the AI.
-        aiResponse := getAIResponse(userMessage, channelName, nick, convKey)
-
-        // Send the response text to the Discord server.
-        session.ChannelMessageSend(channelID, aiResponse)
-    }
-
-    // Remember the time that this message was processed for this conversation.
-    lastMessageMu.Lock()
-    lastMessageAt[convKey] = thisMessageTime
-    lastMessageMu.Unlock()
-}
-
-// This function obtains an AI-generated response to a user message received from Discord.  If
-// successful, it returns the AI-generated response, otherwise it returns a string describing the
-// nature of the error.  
-func getAIResponse(userMessage string, channelName string, nick string, convKey string) string {
-    // This is the API endpoint URL.  See https://docs.anthropic.com/en/api/overview for details
-    // about the Claude API.
-    url := "https://api.anthropic.com/v1/messages"
-
-    // Save the user message as the newest element in the conversation history.  This must happen
-    // before we call json.Marshal(jsonObject).
-    historySaveNewMessage("user", userMessage, convKey)
-
-    // Create the JSON request.  jsonObject will be passed to json.Marshal to convert it into JSON.
-    jsonObject := make(map[string]any)
-
-    // TODO: Switch these next two lines.
-    //jsonObject["model"] = "claude-sonnet-4-0"  // This is an alias for the latest Sonnet 4 version.
-    jsonObject["model"] = "claude-sonnet-4-20250514"
-    jsonObject["max_tokens"] = maxTokens         // The maximum number of tokens the AI will generate.
-    jsonObject["system"] = getSystemPrompt()
-
-    // Get the message history for this channel or nick.  Use nick if channelName is the empty
-    // string, which means we're handling a DM from a user to the bot.
-    var recentMessagesSlice []map[string]string
-    var err error
-
-    recentMessagesSlice, err = historyAsSlice(convKey)
-
-    if err != nil {
-        msg := fmt.Sprintf("%v: getAIResponse: historyAsSlice failed: %v", Me, err)
-        fmt.Println(msg)
-        return msg
-    }
-
-    // Store the recent messages slice in map jsonObject.
-    jsonObject["messages"] = recentMessagesSlice
-
-    if reasoningEnabled {
-        // Here, 'budget_tokens' must be smaller than 'max_tokens' above.
-        jsonObject["thinking"] = map[string]any{ "type": "enabled", "budget_tokens": thinkingMaxTokens }
-    }
-
-    if webSearchEnabled {
-        jsonObject["tools"] = []map[string]any{{"type": "web_search_20250305",
-                                                "name": "web_search",
-                                                "max_uses": maxWebSearches }}
-    }
-
-    requestBody, err := json.Marshal(jsonObject)
-
-    if err != nil {
-        msg := fmt.Sprintf("%v: getAIResponse: json.Marshal failed: %v", Me, err)
-        fmt.Println(msg)
-        return msg
-    }
-
-    // For debugging.
-    // fmt.Println("Request JSON =", string(requestBody))
-
-    // Create the HTTP request from the above requestBody.
-    req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-
-    if err != nil {
-        msg := fmt.Sprintf("%v: getAIResponse: Error creating HTTP request: %v", Me, err)
-        fmt.Println(msg)
-        return msg
-    }
-
-    // Set some required HTTP headers.
-    req.Header.Set("x-api-key", apiKey)
-    req.Header.Set("anthropic-version", "2023-06-01")
-    req.Header.Set("Content-Type", "application/json")
-
-    // Send the HTTP request to the AI and get the HTTP response.  The body of the response is JSON
-    // containing the AI's response to the user's message.
-    client := &http.Client{}
-    httpResponse, err := client.Do(req)
-
-    if err != nil {
-        msg := fmt.Sprintf("%v: getAIResponse: Network communication error: %v", Me, err)
-        fmt.Println(msg)
-        return msg
-    }
-
-    // Close the HTTP connection at this function's return.
-    defer httpResponse.Body.Close()
-
-    // Handle HTTP errors.
-    if httpResponse.StatusCode != http.StatusOK {
-        msg := fmt.Sprintf("%v: getAIResponse: HTTP error: %v", Me, httpResponse.Status)
-        fmt.Println(msg)
-        return msg
-    }
-
-    // Parse the HTTP response from the AI and return the text of the response.
-    return parseAIResponse(httpResponse, convKey)
-}
-
-// This function returns the system prompt to be sent in each JSON request to the AI.
-func getSystemPrompt() string {
-    todaysDate := time.Now().Format(time.DateOnly)
-
-    var webSearchPrompt string
-
-    if reasoningEnabled {
-        webSearchPrompt = "Only use the Web search tool when you do not have the necessary " +
-                          "knowledge to respond. "
-    }
-
-    return fmt.Sprintf("Today's date is %s. You are a helpful assistant that provides concise and " +
-                       "accurate answers to user queries. Your responses should be short: only 2 or 3 " +
-                       "sentences. " +
-                       webSearchPrompt +
-                       "The user is one of a group of people connected to a Discord server (as are you), " +
-                       "but you cannot distinguish one user from another. Your output must use Discord " +
-                       "markdown so that it renders correctly.", todaysDate)
-}
-
-// This function processes the HTTP response from the AI and returns the AI-generated response text.
-func parseAIResponse(httpResponse *http.Response, convKey string) string {
-    jsonBytes, jsonBytesCount, msg := getJSONFromHTTPResponse(httpResponse)
-
-    if msg != "" {
-        return msg
-    }
-
-    // This holds the unmarshaled JSON response from the AI.
-    var response map[string]any
-
-    // Unmarshal the JSON into object 'response'.  Must use jsonBytes[:jsonBytesCount] to avoid reading
-    // beyond the end of the valid data in slice jsonBytes.
-    err := json.Unmarshal(jsonBytes[:jsonBytesCount], &response)
-
-    if err != nil {
-        msg := fmt.Sprintf("Error: Error unmarshalling AI response: %s", err)
-        fmt.Println(msg)
-        return msg
-    }
-
-    // Check if the response contains a 'content' key.
-    contentSlice, ok := response["content"].([]any)
-
-    if !ok || len(contentSlice) == 0 {
-        msg := "Error: Failed to find expected JSON (#0)."
-        fmt.Println(msg)
-        return msg
-    }
-
-    // This will hold the text returned by the AI.
-    aiText := ""
-
-    // This will hold the reasoning trace returned by the AI.
-    thinkingText := ""
-
-    // TODO: Refactor this for loop into a new function.
-
-    // =============================================================================
-    // UNDER CONSTRUCTION
-    // =============================================================================
-
-    // Iterate over all elements of contentSlice and concatenate the text.  contentSlice is a slice
-    // of maps.  This loop extracts the text from each element of contentSlice that has a "type" key
-    // with value "text", concatenates the text, and returns the concatenated text.  All other
-    // "type" values are ignored (e.g., "server_tool_use", "web_search_tool", and "citations"), but
-    // When reasoningEnabled is true, this also handles "type" value "thinking", which comes with
-    // key "thinking" whose value is the reasoning trace.
-
-    for index := 0; index < len(contentSlice); index++ {
-        // Get the map from contentSlice[index].
-        contentElement, ok := contentSlice[index].(map[string]any)
-
-        if !ok {
-            msg := "Error: Failed to find expected JSON (#1)."
-            fmt.Println(msg)
-            return msg
-        }
-
-        // Ignore all content types except "text" and "thinking".
-
-        if contentElement["type"] == "text" {
-            // Extract the text value associated with key "text".
-            elementText, ok := contentElement["text"].(string)
-
-            if !ok {
-                msg := "Error: Failed to find expected JSON (#2)."
-                fmt.Println(msg)
-                return msg
-            }
-
-            aiText += elementText
-
-            // For debugging.
-            // fmt.Printf("text: %v: aiText = '%s'\n", index, aiText)
-        }
-
-        if contentElement["type"] == "thinking" {
-            // Extract the text value associated with key "thinking".
-            elementText, ok := contentElement["thinking"].(string)
-
-            if !ok {
-                msg := "Error: Failed to find expected JSON (#3)."
-                fmt.Println(msg)
-                return msg
-            }
-
-            // Append the thinking text to the AI response.
-            thinkingText += elementText
-
-            // For debugging.
-            // fmt.Printf("thinking: %v: thinkingText = '%s'\n", index, thinkingText)
-        }
+    if err := reloadConfiguration(); err != nil {
+        // Show the whole error, which can describe several problems, one per line.
+        sendLongMessage(responder, fmt.Sprintf("The configuration was not reloaded:\n```\n%v\n```", err))
+        return
     }
 
-    // Update the conversation history to have the AI's response.
-    historySaveNewMessage("assistant", thinkingText+"\n\n"+aiText, convKey)
-
-    // Return the AI-generated response.
-    if reasoningEnabled {
-        return "**<thinking>**" + thinkingText + "\n**</thinking>**\n\n" + aiText
-    } else {
-        return aiText
-    }
+    responder.Send("Configuration reloaded.")
 }
 
-// This function reads the body of the HTTP response and returns the JSON as a byte slice, the
-// number of bytes read, and an error if any.  If no error occurs, the string returned is "".
-func getJSONFromHTTPResponse(httpResponse *http.Response) ([]byte, int, string) {
-    // Get the 'Content-Length' header so we know how big to make the byte slice that will hold
-    // the response body.
-    contentLength := httpResponse.ContentLength
-
-    // For debugging.
-    // fmt.Printf("contentLength = %v\n", contentLength)
-
-    if contentLength <= 0 {
-        // Sometimes the Content-Length header is -1, so we have to wing it.  Hopefully, 1 MB is
-        // enough space.
-        contentLength = 1024 * 1024
-    }
-
-    // Get the text of the body of the response, which contains JSON.
-    jsonBytes := make([]byte, contentLength)
-    jsonBytesCount := 0
-
-    // Each call to httpResponse.Body.Read will fill some (or all) of this sub-slice of jsonBytes
-    // with the next group of bytes, then if necessary the start of this sub-slice will be advanced
-    // along slice jsonBytes to be ready for the next call to Read.
-    jsonBytesForReading := jsonBytes[:contentLength] 
-
-    // Read the entire response body by calling httpResponse.Body.Read() in a loop until err != nil.
-    for {
-        bytesRead, err := httpResponse.Body.Read(jsonBytesForReading)
-
-        // For debugging.
-        // if bytesRead == 0 && err.Error() != "EOF" {
-        //     fmt.Printf("WARNING: bytesRead == 0: err == %v\n", err)
-        // }
-
-        // Increment the accumulated number of  bytes we just read.
-        jsonBytesCount += bytesRead
-
-        // For debugging.
-        // fmt.Printf("bytesRead = %v, jsonBytesCount = %v\n", bytesRead, jsonBytesCount)
-
-        if err != nil {
-            // If we get an EOF error reading the body, break out of the loop.  This is the normal
-            // indication that we have read the entire response body.
-            if err.Error() == "EOF" {
-                break
-            }
-
-            // All other errors are unexpected.
-            msg := fmt.Sprintf("Error: Error reading AI response body: %s", err)
-            fmt.Println(msg)
-            return nil, 0, msg
-        }
-
-        if int64(bytesRead) >= (contentLength - 100) {
-            // We're out of space to hold the rest of the response, which means the JSON in the
-            // response won't un-marshal correctly.
-            msg := fmt.Sprintf("Error: AI response too large to process: bytesRead = %v", bytesRead)
-            fmt.Println(msg)
-            return nil, 0, msg
-        }
-
-        // Advance slice jsonBytesForReading to one byte past the bytes read so far.
-        jsonBytesForReading = jsonBytes[jsonBytesCount:]
+// This function returns true if userID is the Discord user ID of the bot's owner, as configured in
+// cfg.  Otherwise, it tells the user with responder that only the owner can use command, and
+// returns false.
+func checkOwner(cfg *Config, responder Responder, userID string, command string) bool {
+    if cfg.Discord.OwnerID != "" && userID == cfg.Discord.OwnerID {
+        return true
     }
 
-    // For debugging.
-    // fmt.Printf("Got %v bytes of JSON.\n", jsonBytesCount)
-
-    return jsonBytes, jsonBytesCount, ""
+    msg := fmt.Sprintf("Sorry, only %v can use the '%v' command.", cfg.Discord.OwnerName, command)
+    responder.Send(msg)
+    return false
 }
 
-
-// This function sends a message to an arbitrary channel.  Returns the empty string if successful,
-// otherwise returns an error message string.
-func sendMessageToChannel(session *discordgo.Session, channelName string, message string) string {
+// This function sends a message to an arbitrary channel in the server configured in cfg.  Returns
+// the empty string if successful, otherwise returns an error message string.
+func sendMessageToChannel(cfg *Config, session *discordgo.Session, channelName string, message string) string {
     // Get all channels in the server.
-    channels, err := session.GuildChannels("840286104296489000")
+    channels, err := session.GuildChannels(cfg.Discord.GuildID)
 
     if err != nil {
         return fmt.Sprintf("Error: Failed to get server channel list: %v", err)
@@ -746,8 +733,8 @@ func sendMessageToChannel(session *discordgo.Session, channelName string, messag
         return fmt.Sprintf("Error: Channel '%s' not found!", channelName)
     }
 
-    // Send the message to the found channel
-    _, err = session.ChannelMessageSend(targetChannelID, message)
+    // Send the message to the found channel, split into as many messages as needed.
+    err = sendLongMessage(newChannelResponder(session, targetChannelID), message)
 
     if err != nil {
         return fmt.Sprintf("Error: Failed to send message to channel: %v", err)
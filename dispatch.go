@@ -0,0 +1,173 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "sync"
+)
+
+var (
+    // The cause of the cancellation of the jobs that are running or waiting when the dispatcher is
+    // shut down.  This is also the error returned by Submit once the dispatcher is draining.
+    errShuttingDown = errors.New("the bot is shutting down")
+
+    // The error returned by Submit when too many jobs are waiting in a conversation.
+    errQueueFull = errors.New("too many jobs are waiting")
+)
+
+// The dispatcher that runs the queries sent to the AI.  This is replaced in main by one with the
+// configured concurrency limit.
+var queryDispatcher = newDispatcher(1)
+
+// Dispatcher runs jobs (usually queries to the AI) with a limit on how many run at once.  Jobs are
+// queued by conversation key, and the jobs of each conversation run one at a time, in the order
+// they were submitted, so that each exchange with the AI is finished before the next one begins.
+// Jobs of different conversations run concurrently, up to the limit.
+type Dispatcher struct {
+    // The jobs of each conversation that haven't finished, in order.  The first job of each queue
+    // is running or waiting for a slot.  A conversation with no jobs has no queue.
+    queues map[string][]dispatcherJob
+
+    // Each running job holds one of these slots.
+    slots chan struct{}
+
+    // Counts the jobs that have been submitted but haven't finished.
+    jobs sync.WaitGroup
+
+    // True once Drain has been called, after which no more jobs are accepted.
+    closed bool
+
+    // This context is canceled (with cause errShuttingDown) when the dispatcher is shut down, which
+    // cancels the contexts passed to all jobs.
+    ctx    context.Context
+    cancel context.CancelCauseFunc
+
+    // Mutex protecting queues and closed from concurrent access.
+    mu sync.Mutex
+}
+
+// A dispatcherJob is a job queued by Dispatcher.Submit, and the context it was submitted with.
+type dispatcherJob struct {
+    ctx context.Context
+    run func(ctx context.Context)
+}
+
+// This function creates a Dispatcher that runs at most maxConcurrent jobs at once.
+func newDispatcher(maxConcurrent int) *Dispatcher {
+    ctx, cancel := context.WithCancelCause(context.Background())
+
+    return &Dispatcher{
+        queues: make(map[string][]dispatcherJob),
+        slots:  make(chan struct{}, maxConcurrent),
+        ctx:    ctx,
+        cancel: cancel,
+    }
+}
+
+// This method queues job to run after the jobs already queued for the conversation identified by
+// convKey, and returns job's place in line: 0 if no other job of the conversation is running (so
+// job only waits for a free slot), 1 if it's next after the running job, and so on.  If maxWaiting
+// jobs are already waiting behind the running one, it returns errQueueFull instead, and if the
+// dispatcher is draining, it returns errShuttingDown.  job is passed a context derived from ctx
+// that is also canceled when the dispatcher is shut down.  If that context is canceled before job
+// starts, job is run right away with it, so that it can tell the user.
+func (dispatcher *Dispatcher) Submit(ctx context.Context, convKey string, maxWaiting int,
+                                     job func(ctx context.Context)) (int, error) {
+    dispatcher.mu.Lock()
+    defer dispatcher.mu.Unlock()
+
+    if dispatcher.closed {
+        return 0, errShuttingDown
+    }
+
+    queue := dispatcher.queues[convKey]
+
+    if len(queue) > maxWaiting {
+        return 0, errQueueFull
+    }
+
+    dispatcher.queues[convKey] = append(queue, dispatcherJob{ctx: ctx, run: job})
+    dispatcher.jobs.Add(1)
+
+    if len(queue) == 0 {
+        // There is no goroutine running this conversation's jobs, so start one.
+        go dispatcher.runConversation(convKey)
+    }
+
+    return len(queue), nil
+}
+
+// This method runs the jobs queued for the conversation identified by convKey, one at a time,
+// until the queue is empty.
+func (dispatcher *Dispatcher) runConversation(convKey string) {
+    for {
+        dispatcher.mu.Lock()
+        job := dispatcher.queues[convKey][0]
+        dispatcher.mu.Unlock()
+
+        // Cancel the job's context when the dispatcher is shut down, with the same cause.
+        ctx, cancel := context.WithCancelCause(job.ctx)
+        stop := context.AfterFunc(dispatcher.ctx, func() { cancel(context.Cause(dispatcher.ctx)) })
+
+        // Wait for a free slot, unless the job is canceled first.
+        select {
+        case dispatcher.slots <- struct{}{}:
+            job.run(ctx)
+            <-dispatcher.slots
+
+        case <-ctx.Done():
+            job.run(ctx)
+        }
+
+        stop()
+        cancel(nil)
+        dispatcher.jobs.Done()
+
+        dispatcher.mu.Lock()
+        queue := dispatcher.queues[convKey][1:]
+
+        if len(queue) == 0 {
+            delete(dispatcher.queues, convKey)
+            dispatcher.mu.Unlock()
+            return
+        }
+
+        dispatcher.queues[convKey] = queue
+        dispatcher.mu.Unlock()
+    }
+}
+
+// This method cancels the contexts passed to all running and queued jobs, with cause
+// errShuttingDown.
+func (dispatcher *Dispatcher) Shutdown() {
+    dispatcher.cancel(errShuttingDown)
+}
+
+// This method stops the dispatcher from accepting jobs, then waits until the jobs that are running
+// or queued have finished, or ctx is done.  It returns true if the jobs finished.  It doesn't cancel
+// the jobs; call Shutdown for that.
+func (dispatcher *Dispatcher) Drain(ctx context.Context) bool {
+    dispatcher.mu.Lock()
+    dispatcher.closed = true
+    dispatcher.mu.Unlock()
+
+    return waitGroupWait(ctx, &dispatcher.jobs)
+}
+
+// This function waits until waitGroup's counter is zero, or ctx is done.  It returns true if the
+// counter reached zero.
+func waitGroupWait(ctx context.Context, waitGroup *sync.WaitGroup) bool {
+    finished := make(chan struct{})
+
+    go func() {
+        waitGroup.Wait()
+        close(finished)
+    }()
+
+    select {
+    case <-finished:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// This function waits for a value from channel, and fails the test if none arrives soon.
+func receive[T any](t *testing.T, channel <-chan T, what string) T {
+    t.Helper()
+
+    select {
+    case value := <-channel:
+        return value
+    case <-time.After(5 * time.Second):
+        t.Fatalf("timed out waiting for %v", what)
+        panic("unreachable")
+    }
+}
+
+// This test submits jobs to one conversation and checks their places in line, that they run one
+// at a time in the order they were submitted, and that a job submitted when max_waiting jobs are
+// already waiting is refused.
+func TestDispatcherConversationOrder(t *testing.T) {
+    dispatcher := newDispatcher(4)
+    release := make(chan struct{})
+    started := make(chan int, 10)
+
+    var mu sync.Mutex
+    var order []int
+    running := 0
+
+    job := func(number int) func(ctx context.Context) {
+        return func(ctx context.Context) {
+            mu.Lock()
+            running++
+
+            if running > 1 {
+                t.Errorf("job %v started while another job of its conversation was running", number)
+            }
+
+            order = append(order, number)
+            mu.Unlock()
+
+            started <- number
+            <-release
+
+            mu.Lock()
+            running--
+            mu.Unlock()
+        }
+    }
+
+    const maxWaiting = 3
+
+    for number := range maxWaiting + 1 {
+        place, err := dispatcher.Submit(context.Background(), "ch:1", maxWaiting, job(number))
+
+        if err != nil || place != number {
+            t.Fatalf("job %v: got place %v and error %v, expected place %v", number, place, err, number)
+        }
+    }
+
+    if _, err := dispatcher.Submit(context.Background(), "ch:1", maxWaiting, job(99)); err != errQueueFull {
+        t.Fatalf("with %v jobs waiting, got error %v, expected errQueueFull", maxWaiting, err)
+    }
+
+    // Another conversation isn't affected.
+    if place, err := dispatcher.Submit(context.Background(), "ch:2", maxWaiting, func(ctx context.Context) {});
+       place != 0 || err != nil {
+        t.Fatalf("another conversation got place %v and error %v, expected place 0", place, err)
+    }
+
+    for number := range maxWaiting + 1 {
+        if startedNumber := receive(t, started, "a job to start"); startedNumber != number {
+            t.Fatalf("job %v started, expected job %v", startedNumber, number)
+        }
+
+        release <- struct{}{}
+    }
+
+    if !dispatcher.Drain(context.Background()) {
+        t.Fatalf("Drain returned false")
+    }
+
+    if fmt.Sprint(order) != "[0 1 2 3]" {
+        t.Fatalf("jobs ran in order %v, expected [0 1 2 3]", order)
+    }
+}
+
+// This test submits more jobs of different conversations than the dispatcher may run at once, and
+// checks that no more than that many run at a time.
+func TestDispatcherConcurrencyLimit(t *testing.T) {
+    const maxConcurrent = 3
+    const jobCount = 10
+
+    dispatcher := newDispatcher(maxConcurrent)
+    release := make(chan struct{})
+    started := make(chan struct{}, jobCount)
+
+    var mu sync.Mutex
+    running := 0
+    maxRunning := 0
+
+    for index := range jobCount {
+        dispatcher.Submit(context.Background(), fmt.Sprintf("ch:%v", index), 0, func(ctx context.Context) {
+            mu.Lock()
+            running++
+            maxRunning = max(maxRunning, running)
+            mu.Unlock()
+
+            started <- struct{}{}
+            <-release
+
+            mu.Lock()
+            running--
+            mu.Unlock()
+        })
+    }
+
+    for range maxConcurrent {
+        receive(t, started, "a job to start")
+    }
+
+    // Give the other jobs a chance to start, which they mustn't.
+    time.Sleep(50 * time.Millisecond)
+
+    select {
+    case <-started:
+        t.Fatalf("more than %v jobs started at once", maxConcurrent)
+    default:
+    }
+
+    for index := range jobCount {
+        release <- struct{}{}
+
+        if index+maxConcurrent < jobCount {
+            receive(t, started, "a job to start")
+        }
+    }
+
+    if !dispatcher.Drain(context.Background()) {
+        t.Fatalf("Drain returned false")
+    }
+
+    if maxRunning != maxConcurrent {
+        t.Fatalf("at most %v jobs ran at once, expected %v", maxRunning, maxConcurrent)
+    }
+}
+
+// This test checks that Drain stops the dispatcher from accepting jobs and waits for the running
+// and waiting jobs, and that Shutdown cancels their contexts with cause errShuttingDown, so that
+// even the waiting jobs run right away.
+func TestDispatcherDrainAndShutdown(t *testing.T) {
+    dispatcher := newDispatcher(1)
+    causes := make(chan error, 3)
+    started := make(chan struct{}, 3)
+
+    job := func(ctx context.Context) {
+        started <- struct{}{}
+        <-ctx.Done()
+        causes <- context.Cause(ctx)
+    }
+
+    // The first job takes the only slot, and the others wait: one for its conversation, and one
+    // for a slot.
+    dispatcher.Submit(context.Background(), "ch:1", 5, job)
+    receive(t, started, "the first job to start")
+    dispatcher.Submit(context.Background(), "ch:1", 5, job)
+    dispatcher.Submit(context.Background(), "ch:2", 5, job)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+
+    if dispatcher.Drain(ctx) {
+        t.Fatalf("Drain returned true while jobs were running")
+    }
+
+    if _, err := dispatcher.Submit(context.Background(), "ch:3", 5, job); err != errShuttingDown {
+        t.Fatalf("after Drain, Submit returned %v, expected errShuttingDown", err)
+    }
+
+    dispatcher.Shutdown()
+
+    for range 3 {
+        if cause := receive(t, causes, "a job to be canceled"); !errors.Is(cause, errShuttingDown) {
+            t.Fatalf("a job was canceled with cause %v, expected errShuttingDown", cause)
+        }
+    }
+
+    if !dispatcher.Drain(context.Background()) {
+        t.Fatalf("Drain returned false after Shutdown")
+    }
+}
+
+// This test checks that a job whose own context is canceled while it waits is run right away with
+// that context, without waiting for its turn.
+func TestDispatcherCanceledWhileWaiting(t *testing.T) {
+    dispatcher := newDispatcher(1)
+    release := make(chan struct{})
+    started := make(chan struct{})
+
+    dispatcher.Submit(context.Background(), "ch:1", 5, func(ctx context.Context) {
+        close(started)
+        <-release
+    })
+
+    receive(t, started, "the first job to start")
+
+    ctx, cancel := context.WithCancelCause(context.Background())
+    causes := make(chan error, 1)
+
+    dispatcher.Submit(ctx, "ch:2", 5, func(ctx context.Context) { causes <- context.Cause(ctx) })
+    cancel(errQueryCanceled)
+
+    if cause := receive(t, causes, "the canceled job to run"); cause != errQueryCanceled {
+        t.Fatalf("the canceled job ran with cause %v, expected errQueryCanceled", cause)
+    }
+
+    close(release)
+
+    if !dispatcher.Drain(context.Background()) {
+        t.Fatalf("Drain returned false")
+    }
+}
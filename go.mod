@@ -2,7 +2,10 @@ module disbot
 
 go 1.24.2
 
-require github.com/bwmarrin/discordgo v0.29.0
+require (
+	github.com/bwmarrin/discordgo v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/gorilla/websocket v1.4.2 // indirect
@@ -0,0 +1,540 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+)
+
+// A HistoryMessage is one message in a conversation history.
+type HistoryMessage struct {
+    // Either "user" or "assistant".
+    Role string `json:"role"`
+
+    // The content of the message: text and (in "user" messages) images.
+    Content []ContentBlock `json:"content"`
+
+    // The Discord user ID and display name of the person who sent a "user" message.  These are
+    // empty for "assistant" messages.
+    AuthorID   string `json:"author_id,omitempty"`
+    AuthorName string `json:"author_name,omitempty"`
+}
+
+// A ContentBlock is one part of the content of a HistoryMessage.  The backends translate content
+// blocks into their own formats.
+type ContentBlock struct {
+    // Either "text" or "image".
+    Type string `json:"type"`
+
+    // The text of a "text" block.
+    Text string `json:"text,omitempty"`
+
+    // The media type (e.g., "image/png"), the base64-encoded data, and the file name of an "image"
+    // block.
+    MediaType string `json:"media_type,omitempty"`
+    Data      string `json:"data,omitempty"`
+    Name      string `json:"name,omitempty"`
+}
+
+// The maximum length of a line in a JSONLHistoryStore log file.  Longer lines (which only logs
+// written when image data was stored in the history can have) are skipped.
+const MAX_HISTORY_LINE_BYTES = 16 * 1024 * 1024
+
+// This function returns content consisting of text, for use as the Content of a HistoryMessage.
+func textContent(text string) []ContentBlock {
+    return []ContentBlock{{Type: "text", Text: text}}
+}
+
+// This function returns the text of message: the text of its "text" blocks, separated by blank
+// lines.  Other blocks are ignored.
+func (message HistoryMessage) text() string {
+    var texts []string
+
+    for _, block := range message.Content {
+        if block.Type == "text" && block.Text != "" {
+            texts = append(texts, block.Text)
+        }
+    }
+
+    return strings.Join(texts, "\n\n")
+}
+
+// This function returns the number of "image" blocks in message.
+func (message HistoryMessage) imageCount() int {
+    count := 0
+
+    for _, block := range message.Content {
+        if block.Type == "image" {
+            count++
+        }
+    }
+
+    return count
+}
+
+// This function returns a copy of message in which each "image" block is replaced by a short
+// "text" block naming the image (e.g., "[image: screenshot.png]").  The image data is only sent to
+// the AI with the query it's attached to, because keeping it in the history would make every
+// later request (and the history's log file) much larger.
+func (message HistoryMessage) withImagePlaceholders() HistoryMessage {
+    if message.imageCount() == 0 {
+        return message
+    }
+
+    content := make([]ContentBlock, 0, len(message.Content))
+
+    for _, block := range message.Content {
+        if block.Type == "image" {
+            block = ContentBlock{Type: "text", Text: fmt.Sprintf("[image: %v]", block.Name)}
+        }
+
+        content = append(content, block)
+    }
+
+    message.Content = content
+    return message
+}
+
+// UnmarshalJSON decodes a HistoryMessage.  Logs written before messages could contain images hold
+// each message's content as a string, which is decoded as one "text" block.
+func (message *HistoryMessage) UnmarshalJSON(jsonBytes []byte) error {
+    // This type has the same fields as HistoryMessage, but not this method, which would otherwise
+    // call itself.
+    type plainHistoryMessage HistoryMessage
+
+    var decoded struct {
+        plainHistoryMessage
+        Content json.RawMessage `json:"content"`
+    }
+
+    if err := json.Unmarshal(jsonBytes, &decoded); err != nil {
+        return err
+    }
+
+    *message = HistoryMessage(decoded.plainHistoryMessage)
+
+    if len(decoded.Content) == 0 {
+        return nil
+    }
+
+    var text string
+
+    if err := json.Unmarshal(decoded.Content, &text); err == nil {
+        message.Content = textContent(text)
+        return nil
+    }
+
+    return json.Unmarshal(decoded.Content, &message.Content)
+}
+
+// A HistoryStore persists conversation histories so they survive restarts.  The in-memory history
+// in convhist.go is loaded from the store the first time each conversation is used, and every
+// change to it is written to the store.
+type HistoryStore interface {
+    // Load returns all stored messages of the conversation identified by convKey, oldest first.
+    // If nothing is stored for the conversation, it returns an empty slice.
+    Load(convKey string) ([]HistoryMessage, error)
+
+    // Append adds messages to the end of the stored conversation identified by convKey.
+    Append(convKey string, messages ...HistoryMessage) error
+
+    // Rewrite replaces the stored conversation identified by convKey with messages.  This is used
+    // to discard messages that have been trimmed from the in-memory history.
+    Rewrite(convKey string, messages []HistoryMessage) error
+
+    // LoadSummary returns the running summary of the conversation identified by convKey (see
+    // summary.go), or the empty string if there is none.
+    LoadSummary(convKey string) (string, error)
+
+    // SaveSummary replaces the running summary of the conversation identified by convKey.
+    SaveSummary(convKey string, summary string) error
+
+    // Delete removes the stored messages and summary of the conversation identified by convKey.
+    // It is not an error if nothing is stored for the conversation.
+    Delete(convKey string) error
+
+    // Flush makes sure that the changes made so far will survive a crash of the machine (e.g., by
+    // syncing files to disk).  The bot calls it before exiting.
+    Flush() error
+}
+
+// MemoryHistoryStore is a HistoryStore that keeps histories in memory, so they don't survive
+// restarts.  This is the default store, and it's useful for testing.
+type MemoryHistoryStore struct {
+    mu            sync.Mutex
+    conversations map[string][]HistoryMessage
+    summaries     map[string]string
+}
+
+// This function creates an empty MemoryHistoryStore.
+func newMemoryHistoryStore() *MemoryHistoryStore {
+    return &MemoryHistoryStore{conversations: make(map[string][]HistoryMessage),
+                               summaries:     make(map[string]string)}
+}
+
+func (store *MemoryHistoryStore) Load(convKey string) ([]HistoryMessage, error) {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    return append([]HistoryMessage{}, store.conversations[convKey]...), nil
+}
+
+func (store *MemoryHistoryStore) Append(convKey string, messages ...HistoryMessage) error {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    store.conversations[convKey] = append(store.conversations[convKey], messages...)
+    return nil
+}
+
+func (store *MemoryHistoryStore) Rewrite(convKey string, messages []HistoryMessage) error {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    store.conversations[convKey] = append([]HistoryMessage{}, messages...)
+    return nil
+}
+
+func (store *MemoryHistoryStore) LoadSummary(convKey string) (string, error) {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    return store.summaries[convKey], nil
+}
+
+func (store *MemoryHistoryStore) SaveSummary(convKey string, summary string) error {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    store.summaries[convKey] = summary
+    return nil
+}
+
+func (store *MemoryHistoryStore) Delete(convKey string) error {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    delete(store.conversations, convKey)
+    delete(store.summaries, convKey)
+    return nil
+}
+
+func (store *MemoryHistoryStore) Flush() error {
+    // Nothing survives a crash anyway.
+    return nil
+}
+
+// JSONLHistoryStore is a HistoryStore that keeps each conversation in its own append-only log file
+// in a directory.  Each line of a log file is one HistoryMessage encoded as JSON.  Each
+// conversation's summary (if any) is kept in a text file next to its log file.
+type JSONLHistoryStore struct {
+    // The directory containing the log files.
+    dir string
+
+    // The paths of the files written since the last call to Flush.
+    unsynced map[string]bool
+
+    // Mutex serializing access to the log files and unsynced.
+    mu sync.Mutex
+}
+
+// Matches characters that are not safe to use in a file name on all platforms.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// This function creates a JSONLHistoryStore that keeps its log files in dir, creating dir if it
+// doesn't exist.
+func newJSONLHistoryStore(dir string) (*JSONLHistoryStore, error) {
+    err := os.MkdirAll(dir, 0o700)
+
+    if err != nil {
+        return nil, fmt.Errorf("cannot create history directory: %v", err)
+    }
+
+    return &JSONLHistoryStore{dir: dir, unsynced: make(map[string]bool)}, nil
+}
+
+// This function returns the path of the log file for the conversation identified by convKey.
+func (store *JSONLHistoryStore) path(convKey string) string {
+    return filepath.Join(store.dir, unsafeFileNameChars.ReplaceAllString(convKey, "_")+".jsonl")
+}
+
+// This function returns the path of the summary file for the conversation identified by convKey.
+func (store *JSONLHistoryStore) summaryPath(convKey string) string {
+    return filepath.Join(store.dir, unsafeFileNameChars.ReplaceAllString(convKey, "_")+".summary.txt")
+}
+
+func (store *JSONLHistoryStore) Load(convKey string) ([]HistoryMessage, error) {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    file, err := os.Open(store.path(convKey))
+
+    if os.IsNotExist(err) {
+        return []HistoryMessage{}, nil
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer file.Close()
+
+    messages := []HistoryMessage{}
+    reader := bufio.NewReader(file)
+
+    for lineNumber := 1; ; lineNumber++ {
+        line, err := readHistoryLine(reader)
+
+        if err == io.EOF {
+            break
+        }
+
+        if err != nil && err != errHistoryLineTooLong {
+            return nil, err
+        }
+
+        var message HistoryMessage
+
+        if err == nil {
+            err = json.Unmarshal(line, &message)
+        }
+
+        if err != nil {
+            // A partially written last line (e.g., after a crash) or an overly long line is
+            // skipped rather than making the whole conversation unreadable.
+            fmt.Printf("%v: JSONLHistoryStore.Load: Skipping bad line %v in %v: %v\n", Me, lineNumber,
+                       file.Name(), err)
+            continue
+        }
+
+        messages = append(messages, message)
+    }
+
+    return messages, nil
+}
+
+func (store *JSONLHistoryStore) Append(convKey string, messages ...HistoryMessage) error {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    file, err := os.OpenFile(store.path(convKey), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+
+    if err != nil {
+        return err
+    }
+
+    store.unsynced[file.Name()] = true
+
+    // If a crash left the last line partially written, end it, so that the first new message
+    // isn't joined onto it (and lost with it).
+    err = endLastLine(file)
+
+    if err == nil {
+        err = writeHistoryMessages(file, messages)
+    }
+
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+
+    return err
+}
+
+func (store *JSONLHistoryStore) Rewrite(convKey string, messages []HistoryMessage) error {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    store.unsynced[store.path(convKey)] = true
+
+    return writeFileAtomically(store.path(convKey), func(file *os.File) error {
+        return writeHistoryMessages(file, messages)
+    })
+}
+
+func (store *JSONLHistoryStore) LoadSummary(convKey string) (string, error) {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    summary, err := os.ReadFile(store.summaryPath(convKey))
+
+    if os.IsNotExist(err) {
+        return "", nil
+    }
+
+    return string(summary), err
+}
+
+func (store *JSONLHistoryStore) SaveSummary(convKey string, summary string) error {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    store.unsynced[store.summaryPath(convKey)] = true
+
+    return writeFileAtomically(store.summaryPath(convKey), func(file *os.File) error {
+        _, err := file.WriteString(summary)
+        return err
+    })
+}
+
+func (store *JSONLHistoryStore) Delete(convKey string) error {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    for _, path := range []string{store.path(convKey), store.summaryPath(convKey)} {
+        if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (store *JSONLHistoryStore) Flush() error {
+    store.mu.Lock()
+    defer store.mu.Unlock()
+
+    for path := range store.unsynced {
+        if err := syncFile(path); err != nil {
+            return err
+        }
+
+        delete(store.unsynced, path)
+    }
+
+    // Sync the directory too, so that new and renamed files are there after a crash.  Not every
+    // platform can sync a directory (e.g., Windows can't), so errors are ignored.
+    syncFile(store.dir)
+
+    return nil
+}
+
+// This function writes the contents of the file (or directory) at path to disk.  It is not an
+// error if the file doesn't exist (e.g., because it was deleted after it was written).
+func syncFile(path string) error {
+    file, err := os.Open(path)
+
+    if os.IsNotExist(err) {
+        return nil
+    }
+
+    if err != nil {
+        return err
+    }
+
+    err = file.Sync()
+
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+
+    return err
+}
+
+// This function replaces the file at path with the output of write.  It writes a temporary file
+// and renames it over path, so that a crash can't leave a truncated file behind.
+func writeFileAtomically(path string, write func(file *os.File) error) error {
+    file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+
+    if err != nil {
+        return err
+    }
+
+    err = write(file)
+
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+
+    if err == nil {
+        err = os.Rename(file.Name(), path)
+    }
+
+    if err != nil {
+        os.Remove(file.Name())
+    }
+
+    return err
+}
+
+// This function appends a newline to file, which is open for reading and appending, unless it is
+// empty or already ends with one.
+func endLastLine(file *os.File) error {
+    info, err := file.Stat()
+
+    if err != nil || info.Size() == 0 {
+        return err
+    }
+
+    lastByte := make([]byte, 1)
+
+    if _, err := file.ReadAt(lastByte, info.Size()-1); err != nil {
+        return err
+    }
+
+    if lastByte[0] != '\n' {
+        _, err = file.WriteString("\n")
+    }
+
+    return err
+}
+
+// The error returned by readHistoryLine for a line longer than MAX_HISTORY_LINE_BYTES.
+var errHistoryLineTooLong = fmt.Errorf("line is longer than %v bytes", MAX_HISTORY_LINE_BYTES)
+
+// This function reads the next line from reader and returns it without its newline.  If the line is
+// longer than MAX_HISTORY_LINE_BYTES, the rest of it is skipped and errHistoryLineTooLong is
+// returned.  At the end of the input, it returns io.EOF.
+func readHistoryLine(reader *bufio.Reader) ([]byte, error) {
+    var line []byte
+    tooLong := false
+
+    for {
+        fragment, err := reader.ReadSlice('\n')
+
+        if !tooLong {
+            if len(line)+len(fragment) > MAX_HISTORY_LINE_BYTES+1 {
+                tooLong = true
+                line = nil
+            } else {
+                line = append(line, fragment...)
+            }
+        }
+
+        switch {
+        case err == bufio.ErrBufferFull:
+            continue
+        case err == io.EOF && (len(line) > 0 || tooLong):
+            err = nil
+        case err != nil:
+            return nil, err
+        }
+
+        if tooLong {
+            return nil, errHistoryLineTooLong
+        }
+
+        return bytes.TrimSuffix(line, []byte("\n")), nil
+    }
+}
+
+// This function writes messages to file, one JSON-encoded message per line.
+func writeHistoryMessages(file *os.File, messages []HistoryMessage) error {
+    writer := bufio.NewWriter(file)
+    encoder := json.NewEncoder(writer)
+
+    for _, message := range messages {
+        // Encode writes the trailing newline.
+        if err := encoder.Encode(message); err != nil {
+            return err
+        }
+    }
+
+    return writer.Flush()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+    "os"
+    "strings"
+    "testing"
+)
+
+// This test writes a log file whose last line was cut short (as by a crash), and checks that Load
+// returns the messages before it, and that the next Append starts a new line rather than joining
+// its first message onto the broken one.
+func TestJSONLHistoryStoreTruncatedLine(t *testing.T) {
+    store, err := newJSONLHistoryStore(t.TempDir())
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    convKey := "ch:1"
+
+    err = store.Append(convKey, HistoryMessage{Role: "user", Content: textContent("first question")},
+                       HistoryMessage{Role: "assistant", Content: textContent("first answer")})
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    file, err := os.OpenFile(store.path(convKey), os.O_WRONLY|os.O_APPEND, 0o600)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    file.WriteString(`{"role":"user","content":[{"type":"text","text":"second quest`)
+    file.Close()
+
+    messages, err := store.Load(convKey)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(messages) != 2 || messages[0].text() != "first question" || messages[1].text() != "first answer" {
+        t.Fatalf("loaded %+v, expected the first question and answer", messages)
+    }
+
+    err = store.Append(convKey, HistoryMessage{Role: "user", Content: textContent("third question")},
+                       HistoryMessage{Role: "assistant", Content: textContent("third answer")})
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    messages, err = store.Load(convKey)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var texts []string
+
+    for _, message := range messages {
+        texts = append(texts, message.text())
+    }
+
+    if strings.Join(texts, "|") != "first question|first answer|third question|third answer" {
+        t.Fatalf("after appending, loaded %q, expected the first and third exchanges", texts)
+    }
+
+    logBytes, err := os.ReadFile(store.path(convKey))
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if lines := strings.Split(strings.TrimSuffix(string(logBytes), "\n"), "\n"); len(lines) != 5 ||
+       !strings.HasSuffix(lines[2], `second quest`) {
+        t.Fatalf("the log file has lines %q, expected the broken line on a line of its own", lines)
+    }
+}
+
+// This test writes a log file with a line longer than MAX_HISTORY_LINE_BYTES (as written when image
+// data was kept in the history), and checks that Load skips just that line.
+func TestJSONLHistoryStoreOverlongLine(t *testing.T) {
+    store, err := newJSONLHistoryStore(t.TempDir())
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    convKey := "ch:1"
+    hugeImage := ContentBlock{Type: "image", MediaType: "image/png", Data: strings.Repeat("A", MAX_HISTORY_LINE_BYTES)}
+
+    err = store.Append(convKey, HistoryMessage{Role: "user", Content: textContent("before")},
+                       HistoryMessage{Role: "assistant", Content: []ContentBlock{hugeImage}},
+                       HistoryMessage{Role: "user", Content: textContent("after")})
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    messages, err := store.Load(convKey)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(messages) != 2 || messages[0].text() != "before" || messages[1].text() != "after" {
+        t.Fatalf("loaded %v messages, expected the ones before and after the overlong line", len(messages))
+    }
+}
+
+// This test checks that withImagePlaceholders replaces each image with a note naming it, and leaves
+// the original message alone.
+func TestWithImagePlaceholders(t *testing.T) {
+    message := HistoryMessage{Role: "user", AuthorID: "1", Content: []ContentBlock{
+        {Type: "text", Text: "What's wrong here?"},
+        {Type: "image", MediaType: "image/png", Data: "iVBORw0KGgo=", Name: "error.png"},
+    }}
+
+    stored := message.withImagePlaceholders()
+
+    if stored.imageCount() != 0 || stored.text() != "What's wrong here?\n\n[image: error.png]" ||
+       stored.AuthorID != "1" {
+        t.Fatalf("got %+v, expected the image replaced by a placeholder", stored)
+    }
+
+    if message.imageCount() != 1 {
+        t.Fatalf("the original message lost its image")
+    }
+}
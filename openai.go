@@ -0,0 +1,252 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+// The default base URL and model used by the OpenAI-compatible backend.
+const (
+    DEFAULT_OPENAI_BASE_URL = "https://api.openai.com/v1"
+    DEFAULT_OPENAI_MODEL    = "gpt-4o-mini"
+)
+
+// OpenAIBackend is a Backend that uses the OpenAI chat completions API.  Local model servers such
+// as llama.cpp and vLLM implement the same API, so pointing URL at one of them lets the bot run
+// against a local model.
+type OpenAIBackend struct {
+    // The API endpoint URL.
+    URL string
+
+    // The API key sent in the 'Authorization' header.  Local servers usually don't need one, so
+    // this can be the empty string.
+    APIKey string
+
+    // The model used when an AIRequest doesn't specify one.
+    Model string
+
+    // The HTTP client used to send requests.
+    Client *http.Client
+}
+
+// These types describe the JSON of a chat completions request and response.  Only the fields the
+// bot uses are present.
+
+type openAIMessage struct {
+    Role    string `json:"role"`
+    Content string `json:"content"`
+
+    // Some local servers (e.g., llama.cpp and vLLM) return the reasoning trace in this field.
+    ReasoningContent string `json:"reasoning_content,omitempty"`
+}
+
+type openAIRequest struct {
+    Model     string                 `json:"model"`
+    Messages  []openAIRequestMessage `json:"messages"`
+    MaxTokens int                    `json:"max_tokens"`
+}
+
+// A message in a request.  Content is either a string or, for a message with images, an array of
+// content parts.
+type openAIRequestMessage struct {
+    Role    string `json:"role"`
+    Content any    `json:"content"`
+}
+
+type openAIResponse struct {
+    Model string `json:"model"`
+
+    Choices []struct {
+        Message      openAIMessage `json:"message"`
+        FinishReason string        `json:"finish_reason"`
+    } `json:"choices"`
+
+    Usage struct {
+        PromptTokens     int `json:"prompt_tokens"`
+        CompletionTokens int `json:"completion_tokens"`
+
+        PromptTokensDetails struct {
+            CachedTokens int `json:"cached_tokens"`
+        } `json:"prompt_tokens_details"`
+    } `json:"usage"`
+}
+
+// This function creates an OpenAIBackend that uses the API at baseURL (e.g.,
+// "http://localhost:8080/v1") and the given model.  If either is the empty string, the default is
+// used.  HTTP requests that take longer than timeout (including reading the response) fail.  The
+// API key, which is optional, is taken from environment variable OPENAI_API_KEY.
+func newOpenAIBackend(baseURL string, model string, timeout time.Duration) (*OpenAIBackend, error) {
+    if baseURL == "" {
+        baseURL = DEFAULT_OPENAI_BASE_URL
+    }
+
+    if model == "" {
+        model = DEFAULT_OPENAI_MODEL
+    }
+
+    return &OpenAIBackend{
+        URL:    strings.TrimSuffix(baseURL, "/") + "/chat/completions",
+        APIKey: os.Getenv("OPENAI_API_KEY"),
+        Model:  model,
+        Client: &http.Client{Timeout: timeout},
+    }, nil
+}
+
+// Complete sends request to the chat completions API and returns the AI's reply.  Reasoning and Web
+// search are not part of this API, so request.ThinkingBudget and request.MaxWebSearches are
+// ignored.
+func (backend *OpenAIBackend) Complete(ctx context.Context, request *AIRequest) (*AIResponse, error) {
+    jsonObject := backend.buildRequestJSON(request)
+    requestBody, err := json.Marshal(jsonObject)
+
+    if err != nil {
+        return nil, fmt.Errorf("json.Marshal failed: %v", err)
+    }
+
+    // Create the HTTP request from the above requestBody.
+    req, err := http.NewRequestWithContext(ctx, "POST", backend.URL, bytes.NewBuffer(requestBody))
+
+    if err != nil {
+        return nil, fmt.Errorf("Error creating HTTP request: %v", err)
+    }
+
+    req.Header.Set("Content-Type", "application/json")
+
+    if backend.APIKey != "" {
+        req.Header.Set("Authorization", "Bearer "+backend.APIKey)
+    }
+
+    httpResponse, err := backend.Client.Do(req)
+
+    if err != nil {
+        return nil, fmt.Errorf("Network communication error: %w", err)
+    }
+
+    // Close the HTTP connection at this function's return.
+    defer httpResponse.Body.Close()
+
+    // Handle HTTP errors.
+    if httpResponse.StatusCode != http.StatusOK {
+        return nil, newAPIError(httpResponse)
+    }
+
+    aiResponse, err := parseOpenAIResponse(httpResponse)
+
+    if err == nil && aiResponse.Model == "" {
+        // Not every server says which model answered, in which case it's the one requested.
+        aiResponse.Model = jsonObject.Model
+    }
+
+    return aiResponse, err
+}
+
+// This function converts request into a chat completions request.  The system prompt becomes the
+// first message, followed by the conversation history.
+func (backend *OpenAIBackend) buildRequestJSON(request *AIRequest) *openAIRequest {
+    jsonObject := &openAIRequest{
+        Model:     backend.Model,
+        Messages:  make([]openAIRequestMessage, 0, len(request.Messages)+1),
+        MaxTokens: request.MaxTokens,
+    }
+
+    if request.Model != "" {
+        jsonObject.Model = request.Model
+    }
+
+    if request.System != "" {
+        jsonObject.Messages = append(jsonObject.Messages,
+                                     openAIRequestMessage{Role: "system", Content: request.System})
+    }
+
+    for _, message := range request.Messages {
+        jsonObject.Messages = append(jsonObject.Messages,
+                                     openAIRequestMessage{Role: message.Role, Content: openAIContent(message)})
+    }
+
+    return jsonObject
+}
+
+// This function returns the content of message in chat completions format: a string if message
+// has no images (which every server understands), otherwise an array of 'text' and 'image_url'
+// content parts, with each image's data in a data URL.
+func openAIContent(message HistoryMessage) any {
+    if message.imageCount() == 0 {
+        return message.text()
+    }
+
+    parts := make([]map[string]any, 0, len(message.Content))
+
+    for _, block := range message.Content {
+        switch block.Type {
+        case "text":
+            parts = append(parts, map[string]any{"type": "text", "text": block.Text})
+
+        case "image":
+            dataURL := "data:" + block.MediaType + ";base64," + block.Data
+            parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]any{"url": dataURL}})
+        }
+    }
+
+    return parts
+}
+
+// This function processes the HTTP response from the chat completions API and returns the AI's
+// reply.
+func parseOpenAIResponse(httpResponse *http.Response) (*AIResponse, error) {
+    jsonBytes, jsonBytesCount, msg := getJSONFromHTTPResponse(httpResponse)
+
+    if msg != "" {
+        return nil, fmt.Errorf("%s", msg)
+    }
+
+    var response openAIResponse
+
+    err := json.Unmarshal(jsonBytes[:jsonBytesCount], &response)
+
+    if err != nil {
+        return nil, fmt.Errorf("Error unmarshalling AI response: %s", err)
+    }
+
+    if len(response.Choices) == 0 {
+        return nil, fmt.Errorf("Failed to find expected JSON (no choices in response).")
+    }
+
+    choice := response.Choices[0]
+
+    return &AIResponse{
+        Text:       choice.Message.Content,
+        Thinking:   choice.Message.ReasoningContent,
+        StopReason: openAIStopReason(choice.FinishReason),
+        Model:      response.Model,
+        Usage: AIUsage{
+            // OpenAI counts cached tokens as part of the prompt tokens, but the Messages API (and
+            // therefore AIUsage) counts them separately.
+            InputTokens:          response.Usage.PromptTokens - response.Usage.PromptTokensDetails.CachedTokens,
+            OutputTokens:         response.Usage.CompletionTokens,
+            CacheReadInputTokens: response.Usage.PromptTokensDetails.CachedTokens,
+        },
+    }, nil
+}
+
+// This function translates a chat completions 'finish_reason' into the equivalent Messages API
+// 'stop_reason'.  Unknown values are returned unchanged.
+func openAIStopReason(finishReason string) string {
+    switch finishReason {
+    case "stop":
+        return "end_turn"
+    case "length":
+        return "max_tokens"
+    case "tool_calls", "function_call":
+        return "tool_use"
+    case "content_filter":
+        return "refusal"
+    default:
+        return finishReason
+    }
+}
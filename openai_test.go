@@ -0,0 +1,167 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+    "time"
+)
+
+// This function fails the test if the JSON encodings of actual and expected (which is JSON text)
+// aren't equivalent.
+func checkJSON(t *testing.T, what string, actual any, expected string) {
+    t.Helper()
+
+    actualBytes, err := json.Marshal(actual)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var actualValue, expectedValue any
+
+    if err := json.Unmarshal(actualBytes, &actualValue); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := json.Unmarshal([]byte(expected), &expectedValue); err != nil {
+        t.Fatalf("%v: bad expected JSON: %v", what, err)
+    }
+
+    if !reflect.DeepEqual(actualValue, expectedValue) {
+        t.Fatalf("%v: got JSON\n%s\nexpected\n%s", what, actualBytes, expected)
+    }
+}
+
+// This test checks that buildRequestJSON puts the system prompt in a "system" message before the
+// conversation, keeps the conversation's alternating roles, sends text-only messages as strings,
+// and sends messages with images as content parts with each image in a data URL.
+func TestOpenAIRequestJSON(t *testing.T) {
+    backend := &OpenAIBackend{Model: "default-model"}
+
+    request := &AIRequest{
+        System:    "Be helpful.",
+        MaxTokens: 1000,
+        Messages: []HistoryMessage{
+            {Role: "user", Content: textContent("Hello"), AuthorID: "1", AuthorName: "Alice"},
+            {Role: "assistant", Content: textContent("Hi, Alice!")},
+            {Role: "user", AuthorID: "2", AuthorName: "Bob", Content: []ContentBlock{
+                {Type: "text", Text: "What's wrong here?"},
+                {Type: "image", MediaType: "image/png", Data: "iVBORw0KGgo=", Name: "error.png"},
+            }},
+        },
+    }
+
+    checkJSON(t, "with a system prompt", backend.buildRequestJSON(request), `{
+        "model": "default-model",
+        "max_tokens": 1000,
+        "messages": [
+            {"role": "system", "content": "Be helpful."},
+            {"role": "user", "content": "Hello"},
+            {"role": "assistant", "content": "Hi, Alice!"},
+            {"role": "user", "content": [
+                {"type": "text", "text": "What's wrong here?"},
+                {"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}
+            ]}
+        ]
+    }`)
+
+    // Without a system prompt, there's no system message, and the request's model wins.
+    request.System = ""
+    request.Model = "other-model"
+    request.Messages = request.Messages[:1]
+
+    checkJSON(t, "without a system prompt", backend.buildRequestJSON(request), `{
+        "model": "other-model",
+        "max_tokens": 1000,
+        "messages": [{"role": "user", "content": "Hello"}]
+    }`)
+}
+
+// This test sends a request to a fake chat completions server, and checks the HTTP request and the
+// translation of the response: the reasoning trace in 'reasoning_content', the finish reason, the
+// token counts (with cached tokens not counted as input tokens), and the model, which is the one
+// requested when the server doesn't say.
+func TestOpenAIComplete(t *testing.T) {
+    t.Setenv("OPENAI_API_KEY", "secret")
+
+    responses := []string{
+        `{
+            "model": "reported-model",
+            "choices": [{"message": {"role": "assistant", "content": "The answer is 42.",
+                                     "reasoning_content": "Let me think."},
+                         "finish_reason": "length"}],
+            "usage": {"prompt_tokens": 1000, "completion_tokens": 50,
+                      "prompt_tokens_details": {"cached_tokens": 600}}
+        }`,
+        `{
+            "choices": [{"message": {"role": "assistant", "content": "Hello!"}, "finish_reason": "stop"}],
+            "usage": {"prompt_tokens": 10, "completion_tokens": 2}
+        }`,
+    }
+
+    var requestBodies []string
+
+    server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+        if req.URL.Path != "/v1/chat/completions" || req.Header.Get("Authorization") != "Bearer secret" {
+            http.Error(writer, `{"error": {"message": "bad request"}}`, http.StatusBadRequest)
+            return
+        }
+
+        body, _ := io.ReadAll(req.Body)
+        requestBodies = append(requestBodies, string(body))
+
+        writer.Header().Set("Content-Type", "application/json")
+        io.WriteString(writer, responses[len(requestBodies)-1])
+    }))
+
+    defer server.Close()
+
+    backend, err := newOpenAIBackend(server.URL+"/v1/", "local-model", time.Minute)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    request := &AIRequest{System: "Be brief.", MaxTokens: 100,
+                          Messages: []HistoryMessage{{Role: "user", Content: textContent("Question?")}}}
+
+    expected := []AIResponse{
+        {Text: "The answer is 42.", Thinking: "Let me think.", StopReason: "max_tokens", Model: "reported-model",
+         Usage: AIUsage{InputTokens: 400, OutputTokens: 50, CacheReadInputTokens: 600}},
+        {Text: "Hello!", StopReason: "end_turn", Model: "local-model",
+         Usage: AIUsage{InputTokens: 10, OutputTokens: 2}},
+    }
+
+    for index := range expected {
+        response, err := backend.Complete(context.Background(), request)
+
+        if err != nil {
+            t.Fatalf("request %v: %v", index+1, err)
+        }
+
+        if !reflect.DeepEqual(*response, expected[index]) {
+            t.Errorf("request %v: got response %+v, expected %+v", index+1, *response, expected[index])
+        }
+    }
+
+    for _, body := range requestBodies {
+        checkJSON(t, "request body", json.RawMessage(body), `{
+            "model": "local-model",
+            "max_tokens": 100,
+            "messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Question?"}]
+        }`)
+    }
+
+    // An error status becomes an APIError.
+    backend.APIKey = "wrong"
+    _, err = backend.Complete(context.Background(), request)
+
+    if apiError, ok := err.(*APIError); !ok || apiError.StatusCode != 400 || apiError.Message != "bad request" {
+        t.Fatalf("with a bad API key, got error %#v, expected a 400 APIError", err)
+    }
+}
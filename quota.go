@@ -0,0 +1,90 @@
+package main
+
+import (
+    "fmt"
+    "slices"
+    "time"
+)
+
+// This function checks whether query may be sent to the AI without exceeding the quotas in cfg of
+// the user who sent it, the channel it was sent in, or the server that channel belongs to.  The
+// quotas are checked against the usage recorded before the query, so the request that crosses a
+// quota is allowed, and the ones after it are refused.  It returns the empty string if the query
+// may be sent, otherwise a message saying which quota is used up and when it resets.  The bot's
+// owner and the users in the quotas.exempt_users setting have no quotas.
+func checkQuotas(cfg *Config, query *Query) string {
+    if query.UserID == cfg.Discord.OwnerID || slices.Contains(cfg.Quotas.ExemptUsers, query.UserID) {
+        return ""
+    }
+
+    checks := []struct {
+        limits QuotaLimits
+        scope  string
+        owner  string
+    }{
+        {cfg.Quotas.User, "user:" + query.UserID, "you've"},
+        {cfg.Quotas.Channel, "channel:" + query.ChannelID, "this channel has"},
+        {cfg.Quotas.Guild, "guild:" + query.GuildID, "this server has"},
+    }
+
+    now := clock()
+
+    for _, check := range checks {
+        if check.scope == "guild:" {
+            // DMs don't belong to a server.
+            continue
+        }
+
+        daily := usageLedger.Totals(dayPeriod(now), check.scope)
+
+        if msg := checkQuota(check.owner, "daily", check.limits.DailyTokens, check.limits.DailyDollars, daily,
+                             startOfNextDay(now)); msg != "" {
+            return msg
+        }
+
+        monthly := usageLedger.Totals(monthPeriod(now), check.scope)
+
+        if msg := checkQuota(check.owner, "monthly", check.limits.MonthlyTokens, check.limits.MonthlyDollars,
+                             monthly, startOfNextMonth(now)); msg != "" {
+            return msg
+        }
+    }
+
+    return ""
+}
+
+// This function checks totals against a quota of maxTokens tokens and maxDollars US dollars, either
+// of which is unlimited if it's zero.  If the quota is used up, it returns a message saying so, in
+// which owner (e.g., "you've") used up the quota, which is a periodName (e.g., "daily") quota that
+// resets at resetTime.  Otherwise, it returns the empty string.
+func checkQuota(owner string, periodName string, maxTokens int, maxDollars float64, totals UsageTotals,
+                resetTime time.Time) string {
+    var quota string
+
+    switch {
+    case maxTokens > 0 && totals.tokens() >= maxTokens:
+        quota = formatCount(maxTokens) + " tokens"
+    case maxDollars > 0 && totals.Cost >= maxDollars:
+        quota = formatDollars(maxDollars)
+    default:
+        return ""
+    }
+
+    // Discord shows a timestamp in each reader's own time zone.
+    return fmt.Sprintf("Sorry, %v used up the %v quota of %v. It resets <t:%v:R> (<t:%v:f>).", owner,
+                       periodName, quota, resetTime.Unix(), resetTime.Unix())
+}
+
+// This function returns the start of the day after the one containing when, in the bot's local time
+// zone.  Daily quotas reset then.
+func startOfNextDay(when time.Time) time.Time {
+    when = when.Local()
+    return time.Date(when.Year(), when.Month(), when.Day()+1, 0, 0, 0, 0, time.Local)
+}
+
+// This function returns the start of the month after the one containing when, in the bot's local
+// time zone.  Monthly quotas reset then.
+func startOfNextMonth(when time.Time) time.Time {
+    when = when.Local()
+    return time.Date(when.Year(), when.Month()+1, 1, 0, 0, 0, 0, time.Local)
+}
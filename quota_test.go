@@ -0,0 +1,141 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+// This test checks when daily and monthly quotas reset, including at the ends of months and years.
+func TestQuotaResetTimes(t *testing.T) {
+    local := func(year int, month time.Month, day int, hour int, minute int) time.Time {
+        return time.Date(year, month, day, hour, minute, 0, 0, time.Local)
+    }
+
+    testCases := []struct {
+        when      time.Time
+        nextDay   time.Time
+        nextMonth time.Time
+    }{
+        {local(2026, 3, 14, 0, 0), local(2026, 3, 15, 0, 0), local(2026, 4, 1, 0, 0)},
+        {local(2026, 3, 14, 23, 59), local(2026, 3, 15, 0, 0), local(2026, 4, 1, 0, 0)},
+        {local(2026, 2, 28, 12, 0), local(2026, 3, 1, 0, 0), local(2026, 3, 1, 0, 0)},
+        {local(2028, 2, 28, 12, 0), local(2028, 2, 29, 0, 0), local(2028, 3, 1, 0, 0)},
+        {local(2026, 1, 31, 8, 30), local(2026, 2, 1, 0, 0), local(2026, 2, 1, 0, 0)},
+        {local(2026, 12, 31, 23, 59), local(2027, 1, 1, 0, 0), local(2027, 1, 1, 0, 0)},
+    }
+
+    for _, testCase := range testCases {
+        if nextDay := startOfNextDay(testCase.when); !nextDay.Equal(testCase.nextDay) {
+            t.Errorf("startOfNextDay(%v) = %v, expected %v", testCase.when, nextDay, testCase.nextDay)
+        }
+
+        if nextMonth := startOfNextMonth(testCase.when); !nextMonth.Equal(testCase.nextMonth) {
+            t.Errorf("startOfNextMonth(%v) = %v, expected %v", testCase.when, nextMonth, testCase.nextMonth)
+        }
+    }
+}
+
+// This test records usage and checks that checkQuotas refuses queries once a token or dollar quota
+// is used up, counts only the usage of the current day or month, and never refuses the bot's owner
+// or the users in quotas.exempt_users.
+func TestCheckQuotas(t *testing.T) {
+    savedLedger := usageLedger
+    usageLedger = newUsageLedger()
+    t.Cleanup(func() { usageLedger = savedLedger })
+
+    now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.Local)
+    useTestClock(t, &now)
+
+    cfg := defaultConfig()
+    cfg.Discord.OwnerID = "owner"
+    cfg.Quotas.User = QuotaLimits{DailyTokens: 1000, MonthlyDollars: 5}
+    cfg.Quotas.Channel = QuotaLimits{}
+    cfg.Quotas.Guild = QuotaLimits{DailyDollars: 2, MonthlyTokens: 100_000}
+    cfg.Quotas.ExemptUsers = []string{"vip"}
+
+    record := func(when time.Time, userID string, tokens int, cost float64) {
+        usageLedger.Record(UsageRecord{Time: when, UserID: userID, GuildID: "g", ChannelID: "c",
+                                       AIUsage: AIUsage{InputTokens: tokens}, Cost: cost})
+    }
+
+    query := func(userID string) *Query {
+        return &Query{UserID: userID, GuildID: "g", ChannelID: "c"}
+    }
+
+    dailyMessage := func(owner string, quota string) string {
+        reset := time.Date(2026, 4, 1, 0, 0, 0, 0, time.Local).Unix()
+        return fmt.Sprintf("Sorry, %v used up the daily quota of %v. It resets <t:%v:R> (<t:%v:f>).", owner, quota,
+                           reset, reset)
+    }
+
+    monthlyMessage := func(owner string, quota string) string {
+        reset := time.Date(2026, 4, 1, 0, 0, 0, 0, time.Local).Unix()
+        return fmt.Sprintf("Sorry, %v used up the monthly quota of %v. It resets <t:%v:R> (<t:%v:f>).", owner, quota,
+                           reset, reset)
+    }
+
+    // Yesterday's tokens don't count against today's quota, and last month's dollars don't count
+    // against this month's.
+    record(now.AddDate(0, 0, -1), "alice", 5000, 0.01)
+    record(time.Date(2026, 2, 28, 12, 0, 0, 0, time.Local), "alice", 10, 100)
+
+    if msg := checkQuotas(cfg, query("alice")); msg != "" {
+        t.Fatalf("with no usage today, got %q", msg)
+    }
+
+    // The request that crosses a quota is allowed, and the ones after it are refused.
+    record(now, "alice", 999, 0.01)
+
+    if msg := checkQuotas(cfg, query("alice")); msg != "" {
+        t.Fatalf("with 999 tokens used today, got %q", msg)
+    }
+
+    record(now, "alice", 1, 0.01)
+
+    if msg, expected := checkQuotas(cfg, query("alice")), dailyMessage("you've", "1,000 tokens"); msg != expected {
+        t.Fatalf("with 1,000 tokens used today, got %q, expected %q", msg, expected)
+    }
+
+    // A dollar quota.  Bob spent $4 yesterday and $1 today, which uses up his monthly quota.
+    record(now.AddDate(0, 0, -1), "bob", 10, 4)
+    record(now, "bob", 10, 1)
+
+    if msg, expected := checkQuotas(cfg, query("bob")), monthlyMessage("you've", "$5.00"); msg != expected {
+        t.Fatalf("with $5 spent this month, got %q, expected %q", msg, expected)
+    }
+
+    // The server's daily dollar quota is used up by everyone together, which refuses Carol too,
+    // but not the owner or exempt users.
+    record(now, "dave", 10, 0.99)
+
+    if msg, expected := checkQuotas(cfg, query("carol")), dailyMessage("this server has", "$2.00"); msg != expected {
+        t.Fatalf("with $2 spent in the server today, got %q, expected %q", msg, expected)
+    }
+
+    for _, userID := range []string{"owner", "vip"} {
+        if msg := checkQuotas(cfg, query(userID)); msg != "" {
+            t.Fatalf("exempt user %v got %q", userID, msg)
+        }
+    }
+
+    // DMs don't belong to a server, so the server's quota doesn't apply to them.
+    if msg := checkQuotas(cfg, &Query{UserID: "carol", ChannelID: "dm"}); msg != "" {
+        t.Fatalf("in a DM, got %q", msg)
+    }
+
+    // The quotas reset at midnight, which starts a new month as well as a new day.
+    now = time.Date(2026, 4, 1, 0, 0, 0, 0, time.Local).Add(-time.Second)
+
+    if msg := checkQuotas(cfg, query("carol")); msg == "" {
+        t.Fatalf("a second before midnight, the server's daily quota was reset")
+    }
+
+    now = now.Add(time.Second)
+
+    for _, userID := range []string{"alice", "bob", "carol"} {
+        if msg := checkQuotas(cfg, query(userID)); msg != "" {
+            t.Fatalf("on a new day in a new month, %v got %q", userID, msg)
+        }
+    }
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "slices"
+    "sync"
+    "time"
+)
+
+// When the rate limiter has more buckets than this, full buckets are discarded.  A full bucket is
+// the same as no bucket.
+const MAX_RATE_LIMIT_BUCKETS = 1000
+
+// The rate limiter for queries sent to the AI.
+var queryRateLimiter = newRateLimiter()
+
+// A tokenBucket holds the state of one token bucket.  A bucket holds up to its burst size in
+// tokens, and gains a token every interval.  Each query takes a token.
+type tokenBucket struct {
+    // The number of tokens in the bucket at updatedAt.
+    tokens    float64
+    updatedAt time.Time
+
+    // The time when the bucket will be full again.
+    fullAt time.Time
+}
+
+// A bucketCheck identifies a token bucket and the limits that apply to it.
+type bucketCheck struct {
+    key    string
+    limits RateLimit
+
+    // What to tell the user if the bucket is empty (e.g., "you're sending messages too quickly").
+    reason string
+}
+
+// RateLimiter is a set of token buckets identified by keys.
+type RateLimiter struct {
+    buckets map[string]*tokenBucket
+    mu      sync.Mutex
+}
+
+// This function creates a RateLimiter with no buckets.
+func newRateLimiter() *RateLimiter {
+    return &RateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// This method takes a token from each of the buckets in checks, if every one of them has a token
+// at time now, and returns true.  Otherwise, it takes no tokens, and returns false, the time at
+// which every bucket will have a token, and the reason of a bucket that is empty until then.
+// Buckets whose limits have an interval of 0 are unlimited.  New buckets start full.
+func (limiter *RateLimiter) take(now time.Time, checks []bucketCheck) (bool, time.Time, string) {
+    limiter.mu.Lock()
+    defer limiter.mu.Unlock()
+
+    limiter.discardFullBuckets(now)
+
+    allowedAt := now
+    reason := ""
+
+    for _, check := range checks {
+        if check.limits.Interval <= 0 {
+            continue
+        }
+
+        tokens := limiter.tokens(now, check)
+
+        if tokens < 1 {
+            // Find when the bucket gains the rest of the token it lacks.
+            wait := time.Duration(math.Ceil((1 - tokens) * float64(check.limits.Interval)))
+
+            if bucketAllowedAt := now.Add(wait); bucketAllowedAt.After(allowedAt) {
+                allowedAt, reason = bucketAllowedAt, check.reason
+            }
+        }
+    }
+
+    if reason != "" {
+        return false, allowedAt, reason
+    }
+
+    for _, check := range checks {
+        if check.limits.Interval > 0 {
+            tokens := limiter.tokens(now, check) - 1
+            fullAt := now.Add(time.Duration((float64(check.limits.Burst) - tokens) * float64(check.limits.Interval)))
+
+            limiter.buckets[check.key] = &tokenBucket{tokens: tokens, updatedAt: now, fullAt: fullAt}
+        }
+    }
+
+    return true, now, ""
+}
+
+// This method gives back the tokens taken from the buckets in checks by a call to take that
+// returned true, because the query they were taken for was refused for another reason.  No bucket
+// gets more than its burst size.
+func (limiter *RateLimiter) refund(now time.Time, checks []bucketCheck) {
+    limiter.mu.Lock()
+    defer limiter.mu.Unlock()
+
+    for _, check := range checks {
+        if check.limits.Interval > 0 {
+            tokens := math.Min(float64(check.limits.Burst), limiter.tokens(now, check)+1)
+            fullAt := now.Add(time.Duration((float64(check.limits.Burst) - tokens) * float64(check.limits.Interval)))
+
+            limiter.buckets[check.key] = &tokenBucket{tokens: tokens, updatedAt: now, fullAt: fullAt}
+        }
+    }
+}
+
+// This method returns the number of tokens in the bucket identified by check at time now.  The
+// caller must hold limiter.mu.
+func (limiter *RateLimiter) tokens(now time.Time, check bucketCheck) float64 {
+    burst := float64(check.limits.Burst)
+    bucket := limiter.buckets[check.key]
+
+    if bucket == nil {
+        return burst
+    }
+
+    earned := float64(now.Sub(bucket.updatedAt)) / float64(check.limits.Interval)
+
+    return math.Min(burst, bucket.tokens+earned)
+}
+
+// This method discards the buckets that are full at time now, if there are too many buckets.  The
+// caller must hold limiter.mu.
+func (limiter *RateLimiter) discardFullBuckets(now time.Time) {
+    if len(limiter.buckets) <= MAX_RATE_LIMIT_BUCKETS {
+        return
+    }
+
+    for key, bucket := range limiter.buckets {
+        if !now.Before(bucket.fullAt) {
+            delete(limiter.buckets, key)
+        }
+    }
+}
+
+// This function takes a token from the rate limit buckets of the user who sent query, the
+// conversation it's part of, and the whole bot, using the limits in cfg.  If every bucket had a
+// token, it returns the empty string.  Otherwise, it returns a message saying why the query was
+// refused and exactly when the next one will be allowed.  The bot's owner and members of the roles
+// in the rate_limits.exempt_roles setting aren't limited.
+func checkRateLimits(cfg *Config, query *Query) string {
+    if rateLimitExempt(cfg, query) {
+        return ""
+    }
+
+    now := clock()
+
+    allowed, allowedAt, reason := queryRateLimiter.take(now, rateLimitChecks(cfg, query))
+
+    if allowed {
+        return ""
+    }
+
+    seconds := int(math.Ceil(allowedAt.Sub(now).Seconds()))
+
+    // Discord shows a timestamp in each reader's own time zone.  Round up, so that a message sent
+    // at the time shown is allowed.
+    return fmt.Sprintf("Sorry, %v. Please wait %v %v before talking to me again (until <t:%v:T>).", reason,
+                       seconds, plural(seconds, "second", "seconds"), allowedAt.Add(time.Second-1).Unix())
+}
+
+// This function gives back the tokens that checkRateLimits took for query, which was then refused
+// for another reason (e.g., too many queries were already waiting), so that the user isn't charged
+// for it.
+func refundRateLimits(cfg *Config, query *Query) {
+    if !rateLimitExempt(cfg, query) {
+        queryRateLimiter.refund(clock(), rateLimitChecks(cfg, query))
+    }
+}
+
+// This function returns true if the user who sent query isn't rate limited by the settings in cfg,
+// because they are the bot's owner or a member of one of the rate_limits.exempt_roles.
+func rateLimitExempt(cfg *Config, query *Query) bool {
+    if query.UserID == cfg.Discord.OwnerID {
+        return true
+    }
+
+    for _, roleID := range query.RoleIDs {
+        if slices.Contains(cfg.RateLimits.ExemptRoles, roleID) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// This function returns the rate limit buckets that query takes a token from, with their limits in
+// cfg.
+func rateLimitChecks(cfg *Config, query *Query) []bucketCheck {
+    return []bucketCheck{
+        {key: "user:" + query.UserID, limits: cfg.RateLimits.User, reason: "you're sending messages too quickly"},
+        {key: "conv:" + query.ConvKey, limits: cfg.RateLimits.Conversation,
+         reason: "this conversation is moving too quickly"},
+        {key: "global", limits: cfg.RateLimits.Global, reason: "I'm overloaded"},
+    }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+// This function makes clock return *now until the end of the test, so that the test can move time
+// forward by changing *now.
+func useTestClock(t *testing.T, now *time.Time) {
+    savedClock := clock
+    clock = func() time.Time { return *now }
+    t.Cleanup(func() { clock = savedClock })
+}
+
+// This test takes tokens from a bucket until it's empty, and checks that the bucket refuses more
+// until it has earned a token back, and that it never holds more than its burst size.
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+    limiter := newRateLimiter()
+    start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    limits := RateLimit{Interval: 10 * time.Second, Burst: 3}
+    checks := []bucketCheck{{key: "user:1", limits: limits, reason: "slow down"}}
+
+    for index := range 3 {
+        if allowed, _, _ := limiter.take(start, checks); !allowed {
+            t.Fatalf("query %v of the burst was refused", index+1)
+        }
+    }
+
+    allowed, allowedAt, reason := limiter.take(start.Add(4*time.Second), checks)
+
+    if allowed || reason != "slow down" || !allowedAt.Equal(start.Add(10*time.Second)) {
+        t.Fatalf("after the burst, got (%v, %v, %q), expected the query refused until %v", allowed,
+                 allowedAt, reason, start.Add(10*time.Second))
+    }
+
+    if allowed, _, _ := limiter.take(start.Add(10*time.Second), checks); !allowed {
+        t.Fatalf("the query after one interval was refused")
+    }
+
+    if allowed, _, _ := limiter.take(start.Add(10*time.Second), checks); allowed {
+        t.Fatalf("a second query after one interval was allowed")
+    }
+
+    // After a long idle time, the bucket holds only its burst size.
+    later := start.Add(time.Hour)
+
+    for index := range 4 {
+        allowed, _, _ := limiter.take(later, checks)
+
+        if allowed != (index < 3) {
+            t.Fatalf("after an hour, query %v was allowed = %v", index+1, allowed)
+        }
+    }
+}
+
+// This test checks that a bucket whose interval is zero never refuses a query, and that a refused
+// query takes no token from the other buckets.
+func TestRateLimiterUnlimitedAndAllOrNothing(t *testing.T) {
+    limiter := newRateLimiter()
+    now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+    unlimited := bucketCheck{key: "global", limits: RateLimit{Interval: 0, Burst: 0}, reason: "unlimited"}
+
+    for index := range 100 {
+        if allowed, _, _ := limiter.take(now, []bucketCheck{unlimited}); !allowed {
+            t.Fatalf("query %v was refused by an unlimited bucket", index+1)
+        }
+    }
+
+    roomy := bucketCheck{key: "conv:1", limits: RateLimit{Interval: time.Minute, Burst: 2}, reason: "roomy"}
+    tight := bucketCheck{key: "user:1", limits: RateLimit{Interval: time.Minute, Burst: 1}, reason: "tight"}
+
+    limiter.take(now, []bucketCheck{tight})
+
+    if allowed, _, reason := limiter.take(now, []bucketCheck{roomy, tight, unlimited}); allowed || reason != "tight" {
+        t.Fatalf("got (%v, %q), expected the query refused by the tight bucket", allowed, reason)
+    }
+
+    for index := range 2 {
+        if allowed, _, _ := limiter.take(now, []bucketCheck{roomy}); !allowed {
+            t.Fatalf("the refused query took a token from the roomy bucket (query %v refused)", index+1)
+        }
+    }
+}
+
+// This test checks the message checkRateLimits returns when a user sends queries too quickly, and
+// that the bot's owner and members of exempt roles aren't limited.
+func TestCheckRateLimits(t *testing.T) {
+    savedLimiter := queryRateLimiter
+    queryRateLimiter = newRateLimiter()
+    t.Cleanup(func() { queryRateLimiter = savedLimiter })
+
+    now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    useTestClock(t, &now)
+
+    cfg := defaultConfig()
+    cfg.Discord.OwnerID = "owner"
+    cfg.RateLimits.User = RateLimit{Interval: 20 * time.Second, Burst: 3}
+    cfg.RateLimits.Conversation = RateLimit{}
+    cfg.RateLimits.Global = RateLimit{}
+    cfg.RateLimits.ExemptRoles = []string{"moderators"}
+
+    query := &Query{UserID: "user", ConvKey: "ch:1"}
+
+    for index := range 3 {
+        if msg := checkRateLimits(cfg, query); msg != "" {
+            t.Fatalf("query %v of the burst was refused: %v", index+1, msg)
+        }
+    }
+
+    now = now.Add(7 * time.Second)
+
+    // The bucket has earned 7/20 of a token, so the rest takes 13 seconds.
+    expected := fmt.Sprintf("Sorry, you're sending messages too quickly. Please wait 13 seconds before talking "+
+                            "to me again (until <t:%v:T>).", now.Add(13*time.Second).Unix())
+
+    if msg := checkRateLimits(cfg, query); msg != expected {
+        t.Fatalf("got message %q, expected %q", msg, expected)
+    }
+
+    for _, exemptQuery := range []*Query{{UserID: "owner", ConvKey: "ch:1"},
+                                         {UserID: "moderator", ConvKey: "ch:1", RoleIDs: []string{"moderators"}}} {
+        for index := range 10 {
+            if msg := checkRateLimits(cfg, exemptQuery); msg != "" {
+                t.Fatalf("query %v from exempt user %v was refused: %v", index+1, exemptQuery.UserID, msg)
+            }
+        }
+    }
+}
+
+// This test checks that refundRateLimits gives back the token checkRateLimits took, but doesn't let
+// a bucket grow beyond its burst size.
+func TestRefundRateLimits(t *testing.T) {
+    savedLimiter := queryRateLimiter
+    queryRateLimiter = newRateLimiter()
+    t.Cleanup(func() { queryRateLimiter = savedLimiter })
+
+    now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    useTestClock(t, &now)
+
+    cfg := defaultConfig()
+    cfg.Discord.OwnerID = "owner"
+    cfg.RateLimits.User = RateLimit{Interval: time.Minute, Burst: 2}
+    cfg.RateLimits.Conversation = RateLimit{}
+    cfg.RateLimits.Global = RateLimit{}
+
+    query := &Query{UserID: "user", ConvKey: "ch:1"}
+
+    // Refunding a full bucket leaves it with its burst size.
+    refundRateLimits(cfg, query)
+
+    for index := range 2 {
+        if msg := checkRateLimits(cfg, query); msg != "" {
+            t.Fatalf("query %v of the burst was refused: %v", index+1, msg)
+        }
+
+        // The query was refused for another reason, so the token comes back.
+        refundRateLimits(cfg, query)
+    }
+
+    for index := range 3 {
+        msg := checkRateLimits(cfg, query)
+
+        if (msg == "") != (index < 2) {
+            t.Fatalf("after refunds, query %v got message %q", index+1, msg)
+        }
+    }
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+// The maximum number of messages in a reply chain that can be quoted as context (see the
+// discord.reply_context_depth setting).  Every message after the first costs a Discord API call.
+const MAX_REPLY_CONTEXT_DEPTH = 10
+
+// This function returns the quoted context for message, which is a reply to another message, or
+// the empty string if message is not a reply or quoting is disabled in cfg.  The context quotes
+// the message being replied to and, if the discord.reply_context_depth setting allows it, the
+// messages that it replies to, and so on up the reply chain.  botID is the bot's user ID.
+func getReplyContext(cfg *Config, session *discordgo.Session, message *discordgo.Message, botID string) string {
+    depth := cfg.Discord.ReplyContextDepth
+
+    // The replied-to messages, newest first.
+    var chain []*discordgo.Message
+
+    for len(chain) < depth && isReply(message) {
+        // Discord includes the replied-to message in the MessageCreate event, but not the message
+        // that one replies to, so fetch the rest of the chain.
+        referencedMessage := message.ReferencedMessage
+
+        if referencedMessage == nil {
+            channelID := message.MessageReference.ChannelID
+
+            if channelID == "" {
+                channelID = message.ChannelID
+            }
+
+            var err error
+            referencedMessage, err = session.ChannelMessage(channelID, message.MessageReference.MessageID)
+
+            if err != nil {
+                // The message may have been deleted.  Quote what we have.
+                fmt.Printf("%v: getReplyContext: Error getting replied-to message: %v\n", Me, err)
+                break
+            }
+        }
+
+        chain = append(chain, referencedMessage)
+        message = referencedMessage
+    }
+
+    if len(chain) == 0 {
+        return ""
+    }
+
+    var context strings.Builder
+
+    if len(chain) == 1 {
+        context.WriteString("[Quoted context: the message being replied to]\n")
+    } else {
+        context.WriteString("[Quoted context: the message being replied to, preceded by the messages it " +
+                            "replies to, oldest first]\n")
+    }
+
+    for index := len(chain) - 1; index >= 0; index-- {
+        context.WriteString(quoteMessage(chain[index], botID))
+    }
+
+    context.WriteString("[End of quoted context]")
+
+    return context.String()
+}
+
+// This function returns true if message is a reply to another message (as opposed to, e.g., a
+// forwarded message).
+func isReply(message *discordgo.Message) bool {
+    return message.MessageReference != nil && message.MessageReference.Type == discordgo.MessageReferenceTypeDefault
+}
+
+// This function formats message as quoted context for the AI: a speaker label like the ones that
+// labelSpeakers adds (or "[You]" if botID sent it), followed by the message's text, with every line
+// starting with "> ".  Long messages are shortened.
+func quoteMessage(message *discordgo.Message, botID string) string {
+    var label string
+
+    switch {
+    case message.Author == nil:
+        label = "[unknown]: "
+    case message.Author.ID == botID:
+        label = "[You]: "
+    default:
+        label = speakerLabel(HistoryMessage{Role: "user", AuthorID: message.Author.ID,
+                                            AuthorName: getNick(message.Member, message.Author)})
+    }
+
+    text := strings.TrimSpace(message.Content)
+
+    if text == "" {
+        text = "(no text)"
+    } else if runes := []rune(text); len(runes) > DISCORD_MAX_MESSAGE_CHARS {
+        text = string(runes[:DISCORD_MAX_MESSAGE_CHARS]) + " ..."
+    }
+
+    return "> " + strings.ReplaceAll(label+text, "\n", "\n> ") + "\n"
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+// A Responder sends the bot's replies to a query.  A query arrives either as a message in a
+// channel or DM (see channelResponder) or as a slash command (see interactionResponder), and each
+// kind of query is answered differently, but the code that generates replies doesn't need to know
+// which kind it is answering.
+type Responder interface {
+    // Send posts a new message containing text and returns it.
+    Send(text string) (*discordgo.Message, error)
+
+    // Edit replaces the text of message, which was returned by Send.
+    Edit(message *discordgo.Message, text string) error
+
+    // Delete deletes message, which was returned by Send.
+    Delete(message *discordgo.Message) error
+}
+
+// A channelResponder is a Responder that posts ordinary messages in a channel or DM.
+type channelResponder struct {
+    session   *discordgo.Session
+    channelID string
+}
+
+// This function returns a Responder that posts messages in the channel or DM identified by
+// channelID.
+func newChannelResponder(session *discordgo.Session, channelID string) *channelResponder {
+    return &channelResponder{session: session, channelID: channelID}
+}
+
+func (responder *channelResponder) Send(text string) (*discordgo.Message, error) {
+    return responder.session.ChannelMessageSend(responder.channelID, text)
+}
+
+func (responder *channelResponder) Edit(message *discordgo.Message, text string) error {
+    _, err := responder.session.ChannelMessageEdit(responder.channelID, message.ID, text)
+    return err
+}
+
+func (responder *channelResponder) Delete(message *discordgo.Message) error {
+    return responder.session.ChannelMessageDelete(responder.channelID, message.ID)
+}
+
+// An interactionResponder is a Responder that answers a slash command whose response has been
+// deferred (see deferInteraction).  The first message sent replaces Discord's "Bot is thinking..."
+// indicator, and later messages are sent as followup messages.
+type interactionResponder struct {
+    session     *discordgo.Session
+    interaction *discordgo.Interaction
+
+    // The ID of the interaction's original response message, once the first message has been sent.
+    originalID string
+
+    // Mutex protecting originalID from concurrent access.  Messages can be sent by more than one
+    // goroutine (e.g., the one answering a query and the one telling the user it's waiting), so
+    // Send holds this until the original response is sent, so that only one message becomes it.
+    mu sync.Mutex
+}
+
+// This function returns a Responder that answers interaction, whose response has been deferred.
+func newInteractionResponder(session *discordgo.Session, interaction *discordgo.Interaction) *interactionResponder {
+    return &interactionResponder{session: session, interaction: interaction}
+}
+
+func (responder *interactionResponder) Send(text string) (*discordgo.Message, error) {
+    responder.mu.Lock()
+    defer responder.mu.Unlock()
+
+    if responder.originalID == "" {
+        message, err := responder.session.InteractionResponseEdit(responder.interaction,
+                                                                  &discordgo.WebhookEdit{Content: &text})
+
+        if err != nil {
+            return nil, err
+        }
+
+        responder.originalID = message.ID
+        return message, nil
+    }
+
+    return responder.session.FollowupMessageCreate(responder.interaction, true,
+                                                   &discordgo.WebhookParams{Content: text})
+}
+
+func (responder *interactionResponder) Edit(message *discordgo.Message, text string) error {
+    var err error
+
+    if responder.isOriginal(message) {
+        _, err = responder.session.InteractionResponseEdit(responder.interaction,
+                                                           &discordgo.WebhookEdit{Content: &text})
+    } else {
+        _, err = responder.session.FollowupMessageEdit(responder.interaction, message.ID,
+                                                       &discordgo.WebhookEdit{Content: &text})
+    }
+
+    return err
+}
+
+func (responder *interactionResponder) Delete(message *discordgo.Message) error {
+    if responder.isOriginal(message) {
+        return responder.session.InteractionResponseDelete(responder.interaction)
+    }
+
+    return responder.session.FollowupMessageDelete(responder.interaction, message.ID)
+}
+
+// This method returns true if message is the interaction's original response message.
+func (responder *interactionResponder) isOriginal(message *discordgo.Message) bool {
+    responder.mu.Lock()
+    defer responder.mu.Unlock()
+
+    return message.ID == responder.originalID
+}
+
+// This function acknowledges interaction, which makes Discord show "Bot is thinking..." until the
+// response is sent with an interactionResponder.  This must happen within 3 seconds of receiving
+// the interaction, so it is done before any slow work (e.g., querying the AI).  If ephemeral is
+// true, the response is visible only to the user who sent the command.
+func deferInteraction(session *discordgo.Session, interaction *discordgo.Interaction, ephemeral bool) error {
+    response := &discordgo.InteractionResponse{
+        Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+        Data: &discordgo.InteractionResponseData{},
+    }
+
+    if ephemeral {
+        response.Data.Flags = discordgo.MessageFlagsEphemeral
+    }
+
+    err := session.InteractionRespond(interaction, response)
+
+    if err != nil {
+        fmt.Printf("%v: deferInteraction: Error acknowledging interaction: %v\n", Me, err)
+    }
+
+    return err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "net/http"
+    "slices"
+    "strconv"
+    "syscall"
+    "time"
+)
+
+// The HTTP status codes of AI API errors that are worth retrying.  529 is the Messages API's
+// "overloaded" status.
+var retryableStatusCodes = []int{429, 500, 502, 503, 529}
+
+// An APIError is an error response from an AI API.
+type APIError struct {
+    // The HTTP status code and status (e.g., "529 Overloaded").
+    StatusCode int
+    Status     string
+
+    // The error message in the response body, if there is one.
+    Message string
+
+    // How long the API asked us to wait before trying again, or 0 if it didn't say.
+    RetryAfter time.Duration
+}
+
+func (err *APIError) Error() string {
+    if err.Message == "" {
+        return fmt.Sprintf("HTTP error: %v", err.Status)
+    }
+
+    return fmt.Sprintf("HTTP error: %v: %v", err.Status, err.Message)
+}
+
+// A finalError is an error that must not be retried, even if the error it wraps could be (e.g.,
+// because part of the reply was already shown).
+type finalError struct {
+    error
+}
+
+// This function returns an APIError describing httpResponse, whose status is not 200.  It reads
+// (some of) the response body, but the caller must still close it.
+func newAPIError(httpResponse *http.Response) *APIError {
+    apiError := &APIError{
+        StatusCode: httpResponse.StatusCode,
+        Status:     httpResponse.Status,
+        RetryAfter: retryAfterFromHeaders(httpResponse.Header, time.Now()),
+    }
+
+    // Both the Messages API and the chat completions API describe the error in the body like
+    // this.
+    var body struct {
+        Error struct {
+            Message string `json:"message"`
+        } `json:"error"`
+    }
+
+    bodyBytes, _ := io.ReadAll(io.LimitReader(httpResponse.Body, 64*1024))
+
+    if json.Unmarshal(bodyBytes, &body) == nil {
+        apiError.Message = body.Error.Message
+    }
+
+    return apiError
+}
+
+// This function returns how long the response headers in header ask us to wait before trying
+// again, relative to now, or 0 if they don't say.  The standard 'retry-after' header wins.
+// Otherwise, the Messages API's rate limit headers say when each exhausted limit resets, and the
+// latest of those times is used.
+func retryAfterFromHeaders(header http.Header, now time.Time) time.Duration {
+    if retryAfter := header.Get("retry-after"); retryAfter != "" {
+        if seconds, err := strconv.ParseFloat(retryAfter, 64); err == nil && seconds >= 0 {
+            return time.Duration(seconds * float64(time.Second))
+        }
+
+        if retryTime, err := http.ParseTime(retryAfter); err == nil && retryTime.After(now) {
+            return retryTime.Sub(now)
+        }
+    }
+
+    var wait time.Duration
+
+    for _, limit := range []string{"requests", "tokens", "input-tokens", "output-tokens"} {
+        if header.Get("anthropic-ratelimit-"+limit+"-remaining") != "0" {
+            continue
+        }
+
+        resetTime, err := time.Parse(time.RFC3339, header.Get("anthropic-ratelimit-"+limit+"-reset"))
+
+        if err == nil && resetTime.Sub(now) > wait {
+            wait = resetTime.Sub(now)
+        }
+    }
+
+    return wait
+}
+
+// This function returns true if err, returned by a Backend, might not happen if the request is
+// repeated: an overloaded or rate limited API, a server error, a timeout, a refused or reset
+// connection, or a connection that closed in the middle of the response.  Other network errors
+// (e.g., an unknown host, a bad URL, or an invalid TLS certificate) won't go away by themselves, so
+// they aren't retried.
+func isRetryable(err error) bool {
+    var final finalError
+    var apiError *APIError
+    var netError net.Error
+
+    switch {
+    case errors.As(err, &final):
+        return false
+    case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+        // We gave up, so the network isn't to blame.
+        return false
+    case errors.As(err, &apiError):
+        return slices.Contains(retryableStatusCodes, apiError.StatusCode)
+    case errors.As(err, &netError) && netError.Timeout():
+        return true
+    case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+         errors.Is(err, io.ErrUnexpectedEOF):
+        return true
+    default:
+        return false
+    }
+}
+
+// This function calls call, which sends a request to the AI, until it succeeds, it fails with an
+// error that isn't worth retrying, or the retry settings in cfg say to give up.  Between attempts,
+// it waits as long as the API asked, or for an exponentially growing, randomly jittered delay,
+// whichever is longer.  Before each wait, it calls onRetry (if it's not nil) with the error, the
+// number of the next attempt, and the delay.  It returns call's result, or the last error.
+func withRetries(ctx context.Context, cfg *Config, onRetry func(err error, attempt int, delay time.Duration),
+                 call func() (*AIResponse, error)) (*AIResponse, error) {
+    retry := cfg.AI.Retry
+    deadline := time.Now().Add(retry.Deadline)
+
+    for attempt := 1; ; attempt++ {
+        response, err := call()
+
+        if err == nil || !isRetryable(err) || attempt >= retry.MaxAttempts {
+            return response, err
+        }
+
+        // Double the delay after each attempt, up to the maximum, and then pick a random delay
+        // between half and all of that, so that requests that failed together don't retry
+        // together.
+        backoff := min(retry.InitialDelay<<(attempt-1), retry.MaxDelay)
+
+        if backoff <= 0 {
+            // The shift overflowed.
+            backoff = retry.MaxDelay
+        }
+
+        delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+        var apiError *APIError
+
+        if errors.As(err, &apiError) && apiError.RetryAfter > delay {
+            delay = apiError.RetryAfter
+        }
+
+        if time.Now().Add(delay).After(deadline) {
+            return nil, err
+        }
+
+        if onRetry != nil {
+            onRetry(err, attempt+1, delay)
+        }
+
+        select {
+        case <-time.After(delay):
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// This function returns the notice shown to the user while the bot waits delay to retry a request
+// to the AI, which failed with err.  attempt is the number of the next attempt, of maxAttempts.
+func retryNotice(err error, attempt int, maxAttempts int, delay time.Duration) string {
+    reason := "the AI's API is busy"
+
+    var apiError *APIError
+
+    if !errors.As(err, &apiError) {
+        reason = "I couldn't reach the AI"
+    } else if apiError.StatusCode >= 500 && apiError.StatusCode != 529 {
+        reason = "the AI's API had a problem"
+    }
+
+    seconds := max(int(delay.Round(time.Second).Seconds()), 1)
+
+    return fmt.Sprintf("*Still working on it, but %v. Trying again in %v %v (attempt %v of %v) ...*", reason,
+                       seconds, plural(seconds, "second", "seconds"), attempt, maxAttempts)
+}
+
+// This function returns the error described by an 'error' event in a streaming Messages API
+// response, as an APIError with the HTTP status that the same error has in a non-streaming
+// response, so that it can be retried the same way.
+func anthropicStreamError(errorType string, message string) *APIError {
+    statusCodes := map[string]int{
+        "overloaded_error": 529,
+        "rate_limit_error": 429,
+        "api_error":        500,
+    }
+
+    apiError := &APIError{StatusCode: statusCodes[errorType], Status: errorType, Message: message}
+
+    if apiError.StatusCode != 0 {
+        apiError.Status = fmt.Sprintf("%v %v", apiError.StatusCode, errorType)
+    }
+
+    return apiError
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// This test checks that retryAfterFromHeaders understands a retry-after header holding a number of
+// seconds or an HTTP date, and the Messages API's rate limit headers.
+func TestRetryAfterFromHeaders(t *testing.T) {
+    now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+    testCases := []struct {
+        name     string
+        header   map[string]string
+        expected time.Duration
+    }{
+        {"no headers", nil, 0},
+        {"seconds", map[string]string{"Retry-After": "7"}, 7 * time.Second},
+        {"fractional seconds", map[string]string{"Retry-After": "1.5"}, 1500 * time.Millisecond},
+        {"HTTP date", map[string]string{"Retry-After": now.Add(90 * time.Second).Format(http.TimeFormat)},
+         90 * time.Second},
+        {"HTTP date in the past", map[string]string{"Retry-After": now.Add(-time.Minute).Format(http.TimeFormat)}, 0},
+        {"garbage", map[string]string{"Retry-After": "soon"}, 0},
+        {"exhausted rate limits", map[string]string{
+            "Anthropic-Ratelimit-Requests-Remaining": "0",
+            "Anthropic-Ratelimit-Requests-Reset":     now.Add(20 * time.Second).Format(time.RFC3339),
+            "Anthropic-Ratelimit-Tokens-Remaining":   "0",
+            "Anthropic-Ratelimit-Tokens-Reset":       now.Add(40 * time.Second).Format(time.RFC3339),
+         }, 40 * time.Second},
+        {"rate limit not exhausted", map[string]string{
+            "Anthropic-Ratelimit-Requests-Remaining": "5",
+            "Anthropic-Ratelimit-Requests-Reset":     now.Add(20 * time.Second).Format(time.RFC3339),
+         }, 0},
+        {"retry-after wins", map[string]string{
+            "Retry-After":                            "3",
+            "Anthropic-Ratelimit-Requests-Remaining": "0",
+            "Anthropic-Ratelimit-Requests-Reset":     now.Add(20 * time.Second).Format(time.RFC3339),
+         }, 3 * time.Second},
+    }
+
+    for _, testCase := range testCases {
+        t.Run(testCase.name, func(t *testing.T) {
+            header := http.Header{}
+
+            for name, value := range testCase.header {
+                header.Set(name, value)
+            }
+
+            if wait := retryAfterFromHeaders(header, now); wait != testCase.expected {
+                t.Fatalf("got %v, expected %v", wait, testCase.expected)
+            }
+        })
+    }
+}
+
+// This test checks which errors isRetryable says are worth retrying.
+func TestIsRetryable(t *testing.T) {
+    testCases := []struct {
+        err      error
+        expected bool
+    }{
+        {&APIError{StatusCode: 429}, true},
+        {&APIError{StatusCode: 500}, true},
+        {&APIError{StatusCode: 502}, true},
+        {&APIError{StatusCode: 503}, true},
+        {&APIError{StatusCode: 529}, true},
+        {&APIError{StatusCode: 400}, false},
+        {&APIError{StatusCode: 401}, false},
+        {&APIError{StatusCode: 404}, false},
+        {fmt.Errorf("wrapped: %w", &APIError{StatusCode: 529}), true},
+        {finalError{&APIError{StatusCode: 529}}, false},
+        {&url.Error{Op: "Post", URL: "https://example.com", Err: syscall.ECONNRESET}, true},
+        {&url.Error{Op: "Post", URL: "https://example.com", Err: syscall.ECONNREFUSED}, true},
+        {&url.Error{Op: "Post", URL: "https://example.com", Err: errors.New("no such host")}, false},
+        {io.ErrUnexpectedEOF, true},
+        {context.Canceled, false},
+        {context.DeadlineExceeded, false},
+        {errors.New("something else"), false},
+    }
+
+    for _, testCase := range testCases {
+        if retryable := isRetryable(testCase.err); retryable != testCase.expected {
+            t.Errorf("isRetryable(%v) = %v, expected %v", testCase.err, retryable, testCase.expected)
+        }
+    }
+}
+
+// This function returns a config whose retry settings are retry, for testing withRetries.
+func retryTestConfig(retry RetryConfig) *Config {
+    cfg := defaultConfig()
+    cfg.AI.Retry = retry
+    return cfg
+}
+
+// This function returns a call for withRetries that fails with the errors in errs, in order, and
+// then succeeds.  *calls counts the calls.
+func failingCall(calls *int, errs ...error) func() (*AIResponse, error) {
+    return func() (*AIResponse, error) {
+        *calls++
+
+        if *calls <= len(errs) {
+            return nil, errs[*calls-1]
+        }
+
+        return &AIResponse{Text: "done"}, nil
+    }
+}
+
+// This test checks that withRetries retries retryable errors with an exponential backoff that's
+// never shorter than the API asked for, and doesn't retry other errors.
+func TestWithRetries(t *testing.T) {
+    cfg := retryTestConfig(RetryConfig{MaxAttempts: 5, InitialDelay: 4 * time.Millisecond,
+                                       MaxDelay: 8 * time.Millisecond, Deadline: time.Minute})
+
+    overloaded := &APIError{StatusCode: 529, Status: "529 Overloaded"}
+    rateLimited := &APIError{StatusCode: 429, Status: "429 Too Many Requests", RetryAfter: 30 * time.Millisecond}
+
+    calls := 0
+    var attempts []int
+    var delays []time.Duration
+
+    onRetry := func(err error, attempt int, delay time.Duration) {
+        attempts = append(attempts, attempt)
+        delays = append(delays, delay)
+    }
+
+    response, err := withRetries(context.Background(), cfg, onRetry,
+                                 failingCall(&calls, overloaded, overloaded, rateLimited, overloaded))
+
+    if err != nil || response.Text != "done" || calls != 5 {
+        t.Fatalf("got (%v, %v) after %v calls, expected success after 5 calls", response, err, calls)
+    }
+
+    if fmt.Sprint(attempts) != "[2 3 4 5]" {
+        t.Fatalf("onRetry got attempts %v, expected [2 3 4 5]", attempts)
+    }
+
+    // The backoff is 4, 8, 8, and 8 ms (the maximum), jittered down by up to half, except that the
+    // third attempt's error asked for 30 ms.
+    minDelays := []time.Duration{2 * time.Millisecond, 4 * time.Millisecond, 30 * time.Millisecond, 4 * time.Millisecond}
+    maxDelays := []time.Duration{4 * time.Millisecond, 8 * time.Millisecond, 30 * time.Millisecond, 8 * time.Millisecond}
+
+    for index, delay := range delays {
+        if delay < minDelays[index] || delay > maxDelays[index] {
+            t.Errorf("retry %v waited %v, expected %v to %v", index+1, delay, minDelays[index], maxDelays[index])
+        }
+    }
+
+    // An error that isn't worth retrying is returned right away.
+    calls = 0
+    badRequest := &APIError{StatusCode: 400, Status: "400 Bad Request"}
+
+    if _, err := withRetries(context.Background(), cfg, nil, failingCall(&calls, badRequest)); err != badRequest ||
+       calls != 1 {
+        t.Fatalf("got %v after %v calls, expected the 400 error after 1 call", err, calls)
+    }
+}
+
+// This test checks that withRetries gives up when it has made max_attempts attempts, when the next
+// wait would pass the deadline, and when its context is canceled.
+func TestWithRetriesGivesUp(t *testing.T) {
+    overloaded := &APIError{StatusCode: 529, Status: "529 Overloaded"}
+    errs := []error{overloaded, overloaded, overloaded, overloaded, overloaded}
+
+    cfg := retryTestConfig(RetryConfig{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond,
+                                       Deadline: time.Minute})
+    calls := 0
+
+    if _, err := withRetries(context.Background(), cfg, nil, failingCall(&calls, errs...)); err != overloaded ||
+       calls != 3 {
+        t.Fatalf("max_attempts: got %v after %v calls, expected the 529 error after 3 calls", err, calls)
+    }
+
+    // The API asks for a wait longer than the deadline, so there's no point waiting.
+    cfg = retryTestConfig(RetryConfig{MaxAttempts: 5, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond,
+                                      Deadline: 100 * time.Millisecond})
+    rateLimited := &APIError{StatusCode: 429, Status: "429 Too Many Requests", RetryAfter: time.Minute}
+    calls = 0
+    start := time.Now()
+
+    if _, err := withRetries(context.Background(), cfg, nil, failingCall(&calls, rateLimited)); err != rateLimited ||
+       calls != 1 {
+        t.Fatalf("deadline: got %v after %v calls, expected the 429 error after 1 call", err, calls)
+    }
+
+    if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+        t.Fatalf("deadline: waited %v before giving up", elapsed)
+    }
+
+    // Backoffs that add up to more than the deadline.
+    cfg = retryTestConfig(RetryConfig{MaxAttempts: 100, InitialDelay: 20 * time.Millisecond,
+                                      MaxDelay: 20 * time.Millisecond, Deadline: 60 * time.Millisecond})
+    calls = 0
+
+    if _, err := withRetries(context.Background(), cfg, nil, failingCall(&calls, append(errs, errs...)...));
+       err != overloaded || calls < 2 || calls > 7 {
+        t.Fatalf("deadline: got %v after %v calls, expected the 529 error after 2 to 7 calls", err, calls)
+    }
+
+    // Canceling the context stops the wait.
+    cfg = retryTestConfig(RetryConfig{MaxAttempts: 5, InitialDelay: time.Minute, MaxDelay: time.Minute,
+                                      Deadline: time.Hour})
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    calls = 0
+
+    if _, err := withRetries(ctx, cfg, nil, failingCall(&calls, errs...)); !errors.Is(err, context.DeadlineExceeded) ||
+       calls != 1 {
+        t.Fatalf("cancel: got %v after %v calls, expected the context's error after 1 call", err, calls)
+    }
+}
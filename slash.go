@@ -0,0 +1,236 @@
+package main
+
+import (
+    "fmt"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+// The permissions a member needs to see the owner-only slash commands in a server's command list.
+// No permissions are listed, so only the server's administrators see them.  Either way, only the
+// bot's owner can use them.
+var ownerCommandPermissions int64 = 0
+
+// The slash commands (Discord application commands) that the bot registers.  Each one does the
+// same thing as the '!' command of the same name, /usage-by-user does what '!!usage' does, and
+// /ask does what a message starting with '!' does.
+var slashCommands = []*discordgo.ApplicationCommand{
+    {
+        Name:        "ask",
+        Description: "Ask the AI a question",
+        Options: []*discordgo.ApplicationCommandOption{
+            {
+                Type:        discordgo.ApplicationCommandOptionString,
+                Name:        "question",
+                Description: "Your question or message for the AI",
+                Required:    true,
+            },
+        },
+    },
+    {
+        Name:        "help",
+        Description: "Show how to use this bot",
+    },
+    {
+        Name:        "status",
+        Description: "Show the bot's status and uptime",
+    },
+    {
+        Name:        "usage",
+        Description: "Show how many tokens have been used and what they cost",
+        Options: []*discordgo.ApplicationCommandOption{
+            {
+                Type:        discordgo.ApplicationCommandOptionString,
+                Name:        "scope",
+                Description: "Whose usage to show (default: yours)",
+                Choices: []*discordgo.ApplicationCommandOptionChoice{
+                    {Name: "me", Value: "me"},
+                    {Name: "this channel", Value: "channel"},
+                    {Name: "everyone today", Value: "today"},
+                    {Name: "everyone this month", Value: "month"},
+                },
+            },
+        },
+    },
+    {
+        Name:                     "say",
+        Description:              "Post a message in a channel (owner only)",
+        DefaultMemberPermissions: &ownerCommandPermissions,
+        Options: []*discordgo.ApplicationCommandOption{
+            {
+                Type:        discordgo.ApplicationCommandOptionString,
+                Name:        "channel",
+                Description: "The name of the channel",
+                Required:    true,
+            },
+            {
+                Type:        discordgo.ApplicationCommandOptionString,
+                Name:        "message",
+                Description: "The message to post",
+                Required:    true,
+            },
+        },
+    },
+    {
+        Name:                     "reload",
+        Description:              "Reload the bot's configuration file (owner only)",
+        DefaultMemberPermissions: &ownerCommandPermissions,
+    },
+    {
+        Name:                     "usage-by-user",
+        Description:              "Show each user's token usage and cost (owner only)",
+        DefaultMemberPermissions: &ownerCommandPermissions,
+        Options: []*discordgo.ApplicationCommandOption{
+            {
+                Type:        discordgo.ApplicationCommandOptionString,
+                Name:        "period",
+                Description: "The period to show (default: this month)",
+                Choices: []*discordgo.ApplicationCommandOptionChoice{
+                    {Name: "today", Value: "today"},
+                    {Name: "this month", Value: "month"},
+                    {Name: "all time", Value: "all"},
+                },
+            },
+        },
+    },
+}
+
+// This function registers the bot's slash commands with Discord as configured by cfg, either
+// globally (so they work in every server and in DMs) or only in the server identified by the
+// discord.guild_id setting.  The commands are removed from the other place, so they don't appear
+// twice after the setting is changed.  If slash commands are disabled, they are removed from both
+// places.  This must be called after the session is open.
+func registerSlashCommands(cfg *Config, session *discordgo.Session) error {
+    // A bot's application ID is the same as its user ID.
+    appID := session.State.User.ID
+
+    noCommands := []*discordgo.ApplicationCommand{}
+    globalCommands, guildCommands := noCommands, noCommands
+
+    if cfg.Discord.SlashCommands.Enabled {
+        if cfg.Discord.SlashCommands.Scope == "guild" {
+            guildCommands = slashCommands
+        } else {
+            globalCommands = slashCommands
+        }
+    }
+
+    _, err := session.ApplicationCommandBulkOverwrite(appID, "", globalCommands)
+
+    if err != nil {
+        return fmt.Errorf("cannot register global slash commands: %v", err)
+    }
+
+    if cfg.Discord.GuildID != "" {
+        _, err = session.ApplicationCommandBulkOverwrite(appID, cfg.Discord.GuildID, guildCommands)
+
+        if err != nil {
+            return fmt.Errorf("cannot register slash commands in server %v: %v", cfg.Discord.GuildID, err)
+        }
+    }
+
+    return nil
+}
+
+// This function will be called (due to AddHandler) every time a user interacts with the bot, such
+// as by using one of its slash commands.
+func handleInteractionCreateEvent(session *discordgo.Session, interactionCreateEvent *discordgo.InteractionCreate) {
+    // Ignore everything but slash commands.
+    if interactionCreateEvent.Type != discordgo.InteractionApplicationCommand {
+        return
+    }
+
+    // Get the active configuration.  Everything done in response to this command uses this
+    // snapshot, even if the configuration is reloaded before we're done.
+    cfg := currentConfig()
+
+    interaction := interactionCreateEvent.Interaction
+    commandData := interaction.ApplicationCommandData()
+
+    // Get the user who sent the command.  In a server, the user is part of the member info.  In a
+    // DM, there is no member info.
+    member, user := interaction.Member, interaction.User
+
+    if member != nil {
+        user = member.User
+    }
+
+    if user == nil {
+        fmt.Printf("%v: handleInteractionCreateEvent: Ignoring /%v command with no user\n", Me, commandData.Name)
+        return
+    }
+
+    // Acknowledge the command right away, because Discord gives up on it if we don't respond
+    // within 3 seconds, and the AI takes longer than that.  The replies to the owner-only commands
+    // are only shown to the owner.
+    ephemeral := commandData.Name == "say" || commandData.Name == "reload" || commandData.Name == "usage-by-user"
+
+    if deferInteraction(session, interaction, ephemeral) != nil {
+        return
+    }
+
+    responder := newInteractionResponder(session, interaction)
+
+    switch commandData.Name {
+    case "ask":
+        // Send the question to the AI to generate a reply, exactly as if it were a message that
+        // starts with '!'.
+        channel := getChannel(session, interaction.ChannelID)
+
+        sendAIGeneratedResponse(cfg, session, responder, &Query{
+            ChannelName: channel.Name,
+            GuildID:     interaction.GuildID,
+            ChannelID:   interaction.ChannelID,
+            UserID:      user.ID,
+            Nick:        getNick(member, user),
+            RoleIDs:     memberRoles(member),
+            ConvKey:     conversationKey(channel, user.ID),
+            Text:        commandData.GetOption("question").StringValue(),
+        })
+
+    case "help":
+        // Display the help message.
+        sendHelpMessage(cfg, responder)
+
+    case "status":
+        // Display the status message.
+        sendStatusMessage(cfg, responder)
+
+    case "usage":
+        // Display token usage and cost.
+        sendUsageMessage(responder, optionalStringOption(commandData, "scope"), user.ID, interaction.ChannelID)
+
+    case "usage-by-user":
+        // Only the bot's owner can see everyone's usage.
+        if checkOwner(cfg, responder, user.ID, "/usage-by-user") {
+            sendUsageBreakdownMessage(responder, optionalStringOption(commandData, "period"))
+        }
+
+    case "say":
+        // Only the bot's owner can use the '/say' command.
+        if checkOwner(cfg, responder, user.ID, "/say") {
+            sayInChannel(cfg, session, responder, commandData.GetOption("channel").StringValue(),
+                         commandData.GetOption("message").StringValue())
+        }
+
+    case "reload":
+        // Re-read the configuration file.
+        handleReloadCommand(cfg, responder, user.ID, "/reload")
+
+    default:
+        // This can happen if a command was removed from slashCommands but is still registered.
+        responder.Send(fmt.Sprintf("Sorry, I don't know the '/%v' command.", commandData.Name))
+    }
+}
+
+// This function returns the value of the optional string option of commandData named name, or the
+// empty string if it wasn't given.
+func optionalStringOption(commandData discordgo.ApplicationCommandInteractionData, name string) string {
+    for _, option := range commandData.Options {
+        if option.Name == name {
+            return option.StringValue()
+        }
+    }
+
+    return ""
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// The fence that opens and closes a Discord markdown code block.
+const CODE_FENCE = "```"
+
+// This function splits text into chunks of at most limit characters each, so that text that is too
+// long for one Discord message can be sent as several.  Chunks end at the latest paragraph, line,
+// sentence, or word boundary (in that order of preference) that fits.  If a chunk ends inside a
+// code block, the chunk is terminated with a closing fence and the next chunk starts with an
+// opening fence that has the same language tag, so every chunk renders correctly by itself.
+func splitMessage(text string, limit int) []string {
+    var chunks []string
+
+    // The opening fence line (e.g., "```go") of the code block that is open at the start of
+    // remainingText, or "" if no code block is open.
+    openFence := ""
+    remainingText := text
+
+    for {
+        if strings.TrimSpace(remainingText) == "" {
+            // Discord rejects messages that are empty or only whitespace.
+            return chunks
+        }
+
+        // If the previous chunk ended inside a code block, re-open it in this chunk.
+        prefix := ""
+
+        if openFence != "" {
+            prefix = openFence + "\n"
+        }
+
+        if runeCount(prefix+remainingText) <= limit {
+            chunks = append(chunks, prefix+remainingText)
+            return chunks
+        }
+
+        // Leave room for the prefix and for a closing fence, which might be needed.
+        budget := limit - runeCount(prefix) - runeCount("\n"+CODE_FENCE)
+
+        if budget < 1 {
+            budget = 1
+        }
+
+        splitIndex := findSplitIndex(remainingText, budget)
+        chunkText := strings.TrimRight(remainingText[:splitIndex], " \n")
+        remainingText = strings.TrimLeft(remainingText[splitIndex:], "\n")
+
+        if strings.TrimSpace(chunkText) == "" {
+            // The chunk would be only whitespace (e.g., a long run of blank lines), so skip it.
+            continue
+        }
+
+        if remainingText == "" {
+            // Only whitespace remained after the split point.
+            chunks = append(chunks, prefix+chunkText)
+            return chunks
+        }
+
+        openFence = codeFenceAfter(openFence, chunkText)
+        chunk := prefix + chunkText
+
+        if openFence != "" {
+            chunk += "\n" + CODE_FENCE
+        }
+
+        chunks = append(chunks, chunk)
+    }
+}
+
+// This function returns the byte index in text at which to end a chunk of at most budget
+// characters.  The text before the returned index is the chunk.
+func findSplitIndex(text string, budget int) int {
+    // Find the byte index of the end of the first budget characters of text.
+    windowEnd := len(text)
+    runesSeen := 0
+
+    for byteIndex := range text {
+        if runesSeen == budget {
+            windowEnd = byteIndex
+            break
+        }
+
+        runesSeen++
+    }
+
+    window := text[:windowEnd]
+
+    // Don't split so early that the chunk is tiny, unless there's no alternative.
+    minIndex := len(window) / 4
+
+    // Prefer a paragraph boundary, then a line boundary.
+    for _, separator := range []string{"\n\n", "\n"} {
+        if index := strings.LastIndex(window, separator); index > minIndex {
+            return index + len(separator)
+        }
+    }
+
+    // Next, prefer a sentence boundary.
+    sentenceIndex := -1
+
+    for _, separator := range []string{". ", "! ", "? "} {
+        if index := strings.LastIndex(window, separator); index > sentenceIndex {
+            sentenceIndex = index
+        }
+    }
+
+    if sentenceIndex > minIndex {
+        return sentenceIndex + 2
+    }
+
+    // Next, prefer a word boundary, but not one in the whitespace that the text starts with (e.g.,
+    // the indentation of a long URL), which would leave nothing in the chunk.
+    if index := strings.LastIndex(window, " "); index > 0 && strings.TrimSpace(window[:index]) != "" {
+        return index + 1
+    }
+
+    // There's no boundary, so split in the middle of a word.
+    return windowEnd
+}
+
+// This function returns the opening fence line of the code block that is open at the end of text,
+// or "" if none is, given that the code block whose opening fence is openFence (or none if
+// openFence is "") is open at the start of text.
+func codeFenceAfter(openFence string, text string) string {
+    for _, line := range strings.Split(text, "\n") {
+        line = strings.TrimSpace(line)
+
+        if !strings.HasPrefix(line, CODE_FENCE) {
+            continue
+        }
+
+        if openFence != "" {
+            // This closes the open code block.
+            openFence = ""
+        } else if strings.Count(line, CODE_FENCE) == 1 {
+            // This opens a code block.  Keep only the language tag (if any) from the fence line.
+            fields := strings.Fields(strings.TrimPrefix(line, CODE_FENCE))
+            openFence = CODE_FENCE
+
+            if len(fields) > 0 {
+                openFence += fields[0]
+            }
+        }
+    }
+
+    return openFence
+}
+
+// This function returns the number of characters (not bytes) in text.
+func runeCount(text string) int {
+    return len([]rune(text))
+}
+
+// This function sends text with responder, split into as many messages as needed to stay within
+// Discord's message length limit.  The messages are sent in order.  It returns the first error
+// that occurs, after which no more messages are sent.
+func sendLongMessage(responder Responder, text string) error {
+    for _, chunk := range splitMessage(text, DISCORD_MAX_MESSAGE_CHARS) {
+        _, err := responder.Send(chunk)
+
+        if err != nil {
+            fmt.Printf("%v: sendLongMessage: Error sending message: %v\n", Me, err)
+            return err
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+)
+
+// This function returns the text of a code block in language with lineCount numbered lines.
+func codeBlock(language string, lineCount int) string {
+    var lines []string
+
+    for index := range lineCount {
+        lines = append(lines, fmt.Sprintf("print('this is line number %v of the code block')", index))
+    }
+
+    return CODE_FENCE + language + "\n" + strings.Join(lines, "\n") + "\n" + CODE_FENCE
+}
+
+// This test splits texts with splitMessage and checks the chunks, both against the expected chunks
+// (if the test case has them) and for the properties every split must have: no chunk is longer
+// than the limit or blank, and every chunk's code blocks are closed.
+func TestSplitMessage(t *testing.T) {
+    testCases := []struct {
+        name     string
+        text     string
+        limit    int
+        expected []string
+
+        // If this isn't empty, each chunk after the first must start with it, because the split
+        // points are inside the code block it opens.
+        reopenedFence string
+    }{
+        {
+            name:     "short text",
+            text:     "Hello, world!",
+            limit:    20,
+            expected: []string{"Hello, world!"},
+        },
+        {
+            name:     "split at a newline",
+            text:     "first line here\nsecond line words more",
+            limit:    30,
+            expected: []string{"first line here", "second line words more"},
+        },
+        {
+            name:     "split at a space",
+            text:     "one two three four five six",
+            limit:    20,
+            expected: []string{"one two three", "four five six"},
+        },
+        {
+            name:     "newline preferred to a later space",
+            text:     "alpha beta\ngamma delta epsilon zeta",
+            limit:    24,
+            expected: []string{"alpha beta", "gamma delta epsilon zeta"},
+        },
+        {
+            name:     "line longer than the limit",
+            text:     strings.Repeat("a", 25),
+            limit:    10,
+            expected: []string{"aaaaaa", "aaaaaa", "aaaaaa", "aaaaaaa"},
+        },
+        {
+            name:     "blank lines only",
+            text:     "\n\n   \n",
+            limit:    10,
+            expected: []string{},
+        },
+        {
+            name:          "code block open across a split",
+            text:          "Try this:\n" + CODE_FENCE + "go\nfunc main() {\n    fmt.Println(\"hi\")\n}\n" + CODE_FENCE,
+            limit:         40,
+            reopenedFence: CODE_FENCE + "go\n",
+        },
+        {
+            name:          "long code block at the Discord limit",
+            text:          "Here you go:\n\n" + codeBlock("python", 200) + "\n\nThat's all.",
+            limit:         DISCORD_MAX_MESSAGE_CHARS,
+            reopenedFence: CODE_FENCE + "python\n",
+        },
+        {
+            name:          "code block with lines longer than the limit",
+            text:          CODE_FENCE + "\n" + strings.Repeat("x", 5000) + "\n" + CODE_FENCE,
+            limit:         DISCORD_MAX_MESSAGE_CHARS,
+            reopenedFence: CODE_FENCE + "\n",
+        },
+    }
+
+    for _, testCase := range testCases {
+        t.Run(testCase.name, func(t *testing.T) {
+            chunks := splitMessage(testCase.text, testCase.limit)
+
+            if testCase.expected != nil {
+                if fmt.Sprintf("%q", chunks) != fmt.Sprintf("%q", testCase.expected) {
+                    t.Fatalf("got chunks %q, expected %q", chunks, testCase.expected)
+                }
+            }
+
+            for index, chunk := range chunks {
+                if length := runeCount(chunk); length > testCase.limit {
+                    t.Errorf("chunk %v has %v characters, more than the limit of %v", index, length,
+                             testCase.limit)
+                }
+
+                if strings.TrimSpace(chunk) == "" {
+                    t.Errorf("chunk %v is blank", index)
+                }
+
+                if fence := codeFenceAfter("", chunk); fence != "" {
+                    t.Errorf("chunk %v leaves the code block %q open: %q", index, fence, chunk)
+                }
+
+                if index > 0 && !strings.HasPrefix(chunk, testCase.reopenedFence) {
+                    t.Errorf("chunk %v doesn't start with %q: %q", index, testCase.reopenedFence, chunk)
+                }
+            }
+
+            if testCase.expected == nil && len(chunks) < 2 {
+                t.Errorf("got %v chunks, expected the text to be split", len(chunks))
+            }
+        })
+    }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+const (
+    // The maximum number of characters in a Discord message.
+    DISCORD_MAX_MESSAGE_CHARS = 2000
+
+    // The minimum time between edits of a streamed message.  Discord allows about 5 message edits
+    // per 5 seconds per channel, and the bot may be streaming to more than one conversation in the
+    // same channel, so stay well under that.
+    STREAM_EDIT_INTERVAL = 1500 * time.Millisecond
+
+    // The text of the placeholder message posted before the AI's response starts to arrive.
+    STREAM_PLACEHOLDER = "*Thinking ...*"
+)
+
+// A messageStreamer displays an AI response in Discord while it is being generated.  It posts a
+// placeholder message, then repeatedly edits that message to show the partial response (no more
+// often than STREAM_EDIT_INTERVAL), and finally edits it to show the complete response.  A
+// response too long for one message is split with splitMessage, and each additional chunk is
+// posted as a new message once the response grows into it.
+type messageStreamer struct {
+    responder Responder
+
+    // The messages posted so far (the first is the placeholder), and the text each one currently
+    // displays.  These are empty if the placeholder could not be posted.
+    messages     []*discordgo.Message
+    messageTexts []string
+
+    // The time of the most recent update.
+    lastUpdateAt time.Time
+}
+
+// This function posts the placeholder message with responder and returns a messageStreamer that
+// edits it.
+func newMessageStreamer(responder Responder) *messageStreamer {
+    streamer := &messageStreamer{responder: responder}
+
+    message, err := responder.Send(STREAM_PLACEHOLDER)
+
+    if err != nil {
+        fmt.Printf("%v: newMessageStreamer: Error sending placeholder message: %v\n", Me, err)
+    } else {
+        streamer.messages = append(streamer.messages, message)
+        streamer.messageTexts = append(streamer.messageTexts, STREAM_PLACEHOLDER)
+        streamer.lastUpdateAt = time.Now()
+    }
+
+    return streamer
+}
+
+// This function shows partialResponse in the placeholder message (and any messages that follow
+// it), unless they were updated too recently, in which case this does nothing.  Some later call to
+// update or finish will display the text.
+func (streamer *messageStreamer) update(partialResponse string) {
+    if len(streamer.messages) == 0 || time.Since(streamer.lastUpdateAt) < STREAM_EDIT_INTERVAL {
+        return
+    }
+
+    streamer.show(splitMessage(partialResponse, DISCORD_MAX_MESSAGE_CHARS))
+    streamer.lastUpdateAt = time.Now()
+}
+
+// This function shows notice (e.g., that the request to the AI is being retried) in the placeholder
+// message right away, however recently it was updated.  It's only used before any of the response
+// has arrived.
+func (streamer *messageStreamer) notify(notice string) {
+    if len(streamer.messages) == 0 {
+        return
+    }
+
+    streamer.show([]string{notice})
+    streamer.lastUpdateAt = time.Now()
+}
+
+// This function shows the complete response.  If the placeholder message could not be posted, the
+// response is sent as new messages.
+func (streamer *messageStreamer) finish(response string) {
+    if len(streamer.messages) == 0 {
+        sendLongMessage(streamer.responder, response)
+        return
+    }
+
+    chunks := splitMessage(response, DISCORD_MAX_MESSAGE_CHARS)
+    streamer.show(chunks)
+
+    // If the complete response needs fewer messages than the partial response did (e.g., because
+    // it is an error message), delete the extra messages.
+    for index := len(chunks); index < len(streamer.messages); index++ {
+        streamer.responder.Delete(streamer.messages[index])
+    }
+
+    if len(chunks) < len(streamer.messages) {
+        streamer.messages = streamer.messages[:len(chunks)]
+        streamer.messageTexts = streamer.messageTexts[:len(chunks)]
+    }
+}
+
+// This function makes the streamed messages display chunks, editing the messages whose text has
+// changed and posting new messages for chunks that don't have one yet.
+func (streamer *messageStreamer) show(chunks []string) {
+    for index, chunk := range chunks {
+        if chunk == "" {
+            continue
+        }
+
+        if index < len(streamer.messages) {
+            if chunk == streamer.messageTexts[index] {
+                continue
+            }
+
+            err := streamer.responder.Edit(streamer.messages[index], chunk)
+
+            if err != nil {
+                fmt.Printf("%v: messageStreamer.show: Error editing message: %v\n", Me, err)
+            }
+
+            streamer.messageTexts[index] = chunk
+            continue
+        }
+
+        message, err := streamer.responder.Send(chunk)
+
+        if err != nil {
+            fmt.Printf("%v: messageStreamer.show: Error sending message: %v\n", Me, err)
+            return
+        }
+
+        streamer.messages = append(streamer.messages, message)
+        streamer.messageTexts = append(streamer.messageTexts, chunk)
+    }
+}
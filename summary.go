@@ -0,0 +1,251 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "sync"
+)
+
+const (
+    // The model used to summarize conversation history when the anthropic backend is in use and
+    // the history.summary_model setting is empty.  This is cheaper than the model that talks to users.
+    DEFAULT_ANTHROPIC_SUMMARY_MODEL = "claude-3-5-haiku-20241022"
+
+    // The 'max_tokens' value sent in each summarization request.  This also bounds the size of
+    // each conversation's summary, which is sent in every request to the AI.
+    SUMMARY_MAX_TOKENS = 400
+)
+
+var (
+    // This map stores the running summary of each conversation's history that has fallen out of
+    // the history window.  The key is a conversation key (produced by conversationKey()).  A
+    // conversation's summary is loaded from historyStore the first time it is needed.
+    conversationSummaries = make(map[string]string, 10)
+
+    // The number of times the summary of each conversation has been forgotten (e.g., because the
+    // conversation was deleted).  A summarization that started before its conversation's summary
+    // was forgotten doesn't save the summary it writes.
+    summaryGenerations = make(map[string]int, 10)
+
+    // Mutex protecting conversationSummaries and summaryGenerations from concurrent access.
+    conversationSummariesMu sync.Mutex
+
+    // The batches of messages waiting to be folded into each conversation's summary, oldest first.
+    // The first batch of each queue is being summarized.  Each conversation's batches are
+    // summarized one at a time, in order, so that each update of the summary builds on the
+    // previous one.  A conversation with nothing to summarize has no queue.
+    summaryQueues   = make(map[string][]summaryBatch)
+    summaryQueuesMu sync.Mutex
+
+    // Counts the goroutines summarizing conversations in the background, so that the bot can wait
+    // for them before it exits.
+    pendingSummaries sync.WaitGroup
+)
+
+// A summaryBatch is a batch of messages trimmed from a conversation's history, waiting to be folded
+// into its summary.
+type summaryBatch struct {
+    // The configuration in use when the messages were trimmed.
+    cfg *Config
+
+    // The trimmed messages, oldest first.
+    evictedMessages []HistoryMessage
+
+    // The conversation's summary generation (see summaryGenerations) when the messages were
+    // trimmed.
+    generation int
+}
+
+// This function returns the running summary of the conversation identified by convKey, or the
+// empty string if there is none.
+func historyGetSummary(convKey string) string {
+    conversationSummariesMu.Lock()
+    defer conversationSummariesMu.Unlock()
+
+    summary, ok := conversationSummaries[convKey]
+
+    if !ok {
+        var err error
+        summary, err = historyStore.LoadSummary(convKey)
+
+        if err != nil {
+            fmt.Printf("%v: historyGetSummary: Error loading summary for \"%s\": %v\n", Me, convKey, err)
+        }
+
+        conversationSummaries[convKey] = summary
+    }
+
+    return summary
+}
+
+// This function replaces the running summary of the conversation identified by convKey, unless the
+// summary has been forgotten since it was generation (see summaryGenerations).
+func historySetSummary(convKey string, summary string, generation int) {
+    conversationSummariesMu.Lock()
+    defer conversationSummariesMu.Unlock()
+
+    if summaryGenerations[convKey] != generation {
+        // The conversation was deleted while the summary was being written.
+        return
+    }
+
+    conversationSummaries[convKey] = summary
+
+    if err := historyStore.SaveSummary(convKey, summary); err != nil {
+        fmt.Printf("%v: historySetSummary: Error saving summary for \"%s\": %v\n", Me, convKey, err)
+    }
+}
+
+// This function forgets the in-memory copy of the running summary of the conversation identified
+// by convKey, and keeps summarizations that are in progress from saving it again.  The caller is
+// responsible for deleting it from historyStore.
+func historyForgetSummary(convKey string) {
+    conversationSummariesMu.Lock()
+    defer conversationSummariesMu.Unlock()
+
+    delete(conversationSummaries, convKey)
+    summaryGenerations[convKey]++
+}
+
+// This function returns the current summary generation (see summaryGenerations) of the
+// conversation identified by convKey.
+func historySummaryGeneration(convKey string) int {
+    conversationSummariesMu.Lock()
+    defer conversationSummariesMu.Unlock()
+
+    return summaryGenerations[convKey]
+}
+
+// This function queues evictedMessages, which have just been trimmed from the conversation history
+// identified by convKey, to be folded into the conversation's running summary in the background,
+// after the messages trimmed before them.
+func historyQueueSummary(cfg *Config, convKey string, evictedMessages []HistoryMessage) {
+    batch := summaryBatch{cfg: cfg, evictedMessages: evictedMessages,
+                          generation: historySummaryGeneration(convKey)}
+
+    summaryQueuesMu.Lock()
+    defer summaryQueuesMu.Unlock()
+
+    queue := summaryQueues[convKey]
+    summaryQueues[convKey] = append(queue, batch)
+
+    if len(queue) == 0 {
+        // There is no goroutine summarizing this conversation, so start one.
+        pendingSummaries.Add(1)
+        go historySummarizeQueue(convKey)
+    }
+}
+
+// This function summarizes the batches queued for the conversation identified by convKey, one at a
+// time, until the queue is empty.
+func historySummarizeQueue(convKey string) {
+    defer pendingSummaries.Done()
+
+    for {
+        summaryQueuesMu.Lock()
+        batch := summaryQueues[convKey][0]
+        summaryQueuesMu.Unlock()
+
+        historySummarize(batch.cfg, convKey, batch.evictedMessages, batch.generation)
+
+        summaryQueuesMu.Lock()
+        queue := summaryQueues[convKey][1:]
+
+        if len(queue) == 0 {
+            delete(summaryQueues, convKey)
+            summaryQueuesMu.Unlock()
+            return
+        }
+
+        summaryQueues[convKey] = queue
+        summaryQueuesMu.Unlock()
+    }
+}
+
+// This function folds evictedMessages, which were trimmed from the conversation history identified
+// by convKey when its summary generation was generation, into the conversation's running summary.
+// It asks the AI (using the backend and the history.summary_model setting in cfg) to write the new
+// summary.  If that fails, the evicted messages are forgotten.  If the conversation's summary has
+// been forgotten since the messages were trimmed (e.g., because the conversation was deleted),
+// nothing is done.  This is called by historySummarizeQueue.
+func historySummarize(cfg *Config, convKey string, evictedMessages []HistoryMessage, generation int) {
+    if historySummaryGeneration(convKey) != generation {
+        return
+    }
+
+    // Build the summarization request.
+    var prompt strings.Builder
+
+    if summary := historyGetSummary(convKey); summary != "" {
+        prompt.WriteString("Here is the current summary of the conversation:\n\n" + summary + "\n\n")
+    }
+
+    prompt.WriteString("Here are the next messages in the conversation:\n\n")
+
+    for _, message := range evictedMessages {
+        // The summary model doesn't see images, but it can note that there were some.
+        text := message.text()
+
+        if images := message.imageCount(); images > 0 {
+            text += fmt.Sprintf(" [%v image(s) not shown]", images)
+        }
+
+        if label := speakerLabel(message); label != "" {
+            prompt.WriteString(label + text + "\n\n")
+        } else {
+            fmt.Fprintf(&prompt, "[%s]: %s\n\n", message.Role, text)
+        }
+    }
+
+    prompt.WriteString("Write an updated summary that covers the whole conversation so far.")
+
+    request := &AIRequest{
+        Model: cfg.History.SummaryModel,
+        System: "You maintain a running summary of a conversation between the users of a Discord " +
+                "server and an AI assistant. The summary lets the assistant remember what was " +
+                "discussed after the messages themselves are gone. User messages are labeled with the " +
+                "speaker's name and Discord mention. Keep the topics, facts, who said what, " +
+                "decisions, and open questions that might matter later, and drop small talk. " +
+                "Write at most 200 words of plain text, and output only the summary.",
+        Messages:  []HistoryMessage{{Role: "user", Content: textContent(prompt.String())}},
+        MaxTokens: SUMMARY_MAX_TOKENS,
+    }
+
+    // Summaries run in the background, so retry quietly if the AI's API is busy, but don't wait
+    // forever.
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.AI.RequestTimeout)
+    defer cancel()
+
+    response, err := withRetries(ctx, cfg, nil, func() (*AIResponse, error) {
+        return cfg.backend.Complete(ctx, request)
+    })
+
+    if err != nil {
+        fmt.Printf("%v: historySummarize: Error summarizing \"%s\": %v\n", Me, convKey, err)
+        return
+    }
+
+    recordUsage(cfg, nil, convKey, response)
+
+    historySetSummary(convKey, strings.TrimSpace(response.Text), generation)
+}
+
+// This function returns the text added to the system prompt to give the AI the running summary of
+// the conversation identified by convKey, or the empty string if there is no summary or the history
+// settings in cfg don't enable summarization.  A summary saved while summarization was enabled is
+// left out when it's disabled, because historyTokenBudget no longer leaves room for it.
+func getSummaryPrompt(cfg *Config, convKey string) string {
+    if !cfg.History.Summarize {
+        return ""
+    }
+
+    summary := historyGetSummary(convKey)
+
+    if summary == "" {
+        return ""
+    }
+
+    return " The messages in this conversation are only the most recent ones. Here is a summary " +
+           "of the earlier part of the conversation:\n\n" + summary
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+// This test checks that the running summary of a conversation is only given to the AI while
+// summarization is enabled.
+func TestSummaryPromptFollowsSummarizeSetting(t *testing.T) {
+    convKey := "ch:summary-test"
+    savedStore := historyStore
+    historyStore = newMemoryHistoryStore()
+
+    t.Cleanup(func() {
+        historyForgetSummary(convKey)
+        historyStore = savedStore
+    })
+
+    historySetSummary(convKey, "Alice asked about Go generics.", historySummaryGeneration(convKey))
+
+    cfg := defaultConfig()
+    cfg.History.Summarize = true
+
+    if prompt := getSummaryPrompt(cfg, convKey); !strings.Contains(prompt, "Alice asked about Go generics.") {
+        t.Fatalf("with summarization enabled, got summary prompt %q", prompt)
+    }
+
+    cfg.History.Summarize = false
+
+    if prompt := getSummaryPrompt(cfg, convKey); prompt != "" {
+        t.Fatalf("with summarization disabled, got summary prompt %q", prompt)
+    }
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+const (
+    // The number of minutes of inactivity after which Discord archives the threads the bot creates.
+    THREAD_AUTO_ARCHIVE_MINUTES = 1440
+
+    // The maximum number of characters in the name of a thread the bot creates.  Discord allows
+    // 100.
+    THREAD_NAME_MAX_CHARS = 80
+)
+
+// This function returns true if the bot can start a thread from a message in channel, which is
+// only possible in a server's text and announcement channels.
+func canStartThread(channel *discordgo.Channel) bool {
+    return channel.Type == discordgo.ChannelTypeGuildText || channel.Type == discordgo.ChannelTypeGuildNews
+}
+
+// This function posts answer, which is the AI's answer to query, in a new thread started from the
+// query's message, if the discord.threads.auto_thread_chars setting in cfg says answer is too
+// long for the channel.  The query and answer are copied into the new thread's conversation
+// history, so that the conversation can continue in the thread.  It returns the new thread, or nil
+// if answer should be posted in the channel as usual (including when creating the thread fails).
+func moveAnswerToThread(cfg *Config, session *discordgo.Session, query *Query, answer string) *discordgo.Channel {
+    threshold := cfg.Discord.Threads.AutoThreadChars
+
+    if threshold == 0 || !query.ThreadAllowed || query.MessageID == "" || runeCount(answer) <= threshold {
+        return nil
+    }
+
+    thread, err := session.MessageThreadStart(query.ChannelID, query.MessageID, threadName(query),
+                                              THREAD_AUTO_ARCHIVE_MINUTES)
+
+    if err != nil {
+        fmt.Printf("%v: moveAnswerToThread: Error starting thread: %v\n", Me, err)
+        return nil
+    }
+
+    err = sendLongMessage(newChannelResponder(session, thread.ID), answer)
+
+    if err != nil {
+        // The answer might be partly posted in the thread, but post it in the channel too, so
+        // that it isn't lost.
+        return nil
+    }
+
+    historyCopyLastExchange(cfg, query.ConvKey, threadConversationKey(thread.ID))
+
+    return thread
+}
+
+// This function returns the message posted in place of an answer that was moved to thread.
+func threadLinkMessage(thread *discordgo.Channel) string {
+    return fmt.Sprintf("That's a long answer, so I put it in a thread: <#%v>", thread.ID)
+}
+
+// This function returns the name of a thread created to hold the answer to query.  This is the
+// first line of the query's text, shortened if necessary.
+func threadName(query *Query) string {
+    name, _, _ := strings.Cut(strings.TrimSpace(query.Text), "\n")
+
+    if runes := []rune(name); len(runes) > THREAD_NAME_MAX_CHARS {
+        name = strings.TrimSpace(string(runes[:THREAD_NAME_MAX_CHARS-3])) + "..."
+    }
+
+    if name == "" {
+        name = "Answer for " + query.Nick
+    }
+
+    return name
+}
+
+// This function returns quoted context (see getReplyContext) containing the message that started
+// thread, or the empty string if there is no such message, or it is the message identified by
+// messageID (i.e., the query itself).  botID is the bot's user ID.
+func getThreadStarterContext(session *discordgo.Session, thread *discordgo.Channel, messageID string,
+                             botID string) string {
+    // A thread started from a message in a text channel has the same ID as that message.  A post
+    // in a forum channel is a thread whose first message has the same ID as the thread.
+    starter, err := session.ChannelMessage(thread.ParentID, thread.ID)
+
+    if err != nil {
+        starter, err = session.ChannelMessage(thread.ID, thread.ID)
+    }
+
+    if err != nil {
+        // The thread wasn't started from a message, or the message was deleted.
+        return ""
+    }
+
+    if starter.ID == messageID {
+        return ""
+    }
+
+    return "[Quoted context: the message that started this thread]\n" + quoteMessage(starter, botID) +
+           "[End of quoted context]"
+}
+
+// This function will be called (due to AddHandler) every time a thread is changed.  When a thread
+// is archived, its conversation history is forgotten.
+func handleThreadUpdateEvent(session *discordgo.Session, threadUpdateEvent *discordgo.ThreadUpdate) {
+    if threadUpdateEvent.Channel == nil || threadUpdateEvent.ThreadMetadata == nil ||
+       !threadUpdateEvent.ThreadMetadata.Archived {
+        return
+    }
+
+    historyDelete(threadConversationKey(threadUpdateEvent.ID))
+}
+
+// This function will be called (due to AddHandler) every time a thread is deleted.  The thread's
+// conversation history is forgotten.
+func handleThreadDeleteEvent(session *discordgo.Session, threadDeleteEvent *discordgo.ThreadDelete) {
+    if threadDeleteEvent.Channel == nil {
+        return
+    }
+
+    historyDelete(threadConversationKey(threadDeleteEvent.ID))
+}
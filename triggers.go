@@ -0,0 +1,54 @@
+package main
+
+import (
+    "strings"
+
+    "github.com/bwmarrin/discordgo"
+)
+
+// This function returns true if the message in messageCreateEvent, which doesn't start with '!',
+// should be sent to the AI anyway because of one of the triggers enabled in cfg: it mentions the
+// bot, it is a reply to one of the bot's messages, or it is a DM.  botID is the bot's user ID.
+func isTriggered(cfg *Config, messageCreateEvent *discordgo.MessageCreate, botID string) bool {
+    triggers := cfg.Discord.Triggers
+
+    // Messages in a DM have no server ID.
+    if triggers.DM && messageCreateEvent.GuildID == "" {
+        return true
+    }
+
+    // Check the text for the mention rather than checking messageCreateEvent.Mentions, because
+    // Discord also lists the author of the replied-to message there, and replies are a separate
+    // trigger.
+    if triggers.Mention && mentionsUser(messageCreateEvent.Content, botID) {
+        return true
+    }
+
+    if triggers.Reply {
+        referencedMessage := messageCreateEvent.ReferencedMessage
+
+        if isReply(messageCreateEvent.Message) && referencedMessage != nil && referencedMessage.Author != nil &&
+           referencedMessage.Author.ID == botID {
+            return true
+        }
+    }
+
+    return false
+}
+
+// This function returns true if text contains a mention of the user identified by userID.
+func mentionsUser(text string, userID string) bool {
+    return strings.Contains(text, "<@"+userID+">") || strings.Contains(text, "<@!"+userID+">")
+}
+
+// This function removes all mentions of the user identified by userID from text, along with the
+// whitespace the removal leaves at either end.  Whitespace left between words is collapsed, so
+// "What is <@123> doing?" becomes "What is doing?", rather than containing two spaces.
+func stripMention(text string, userID string) string {
+    for _, mention := range []string{"<@" + userID + ">", "<@!" + userID + ">"} {
+        text = strings.ReplaceAll(text, " "+mention+" ", " ")
+        text = strings.ReplaceAll(text, mention, "")
+    }
+
+    return strings.TrimSpace(text)
+}
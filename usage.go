@@ -0,0 +1,469 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The usage period covering all time.  Daily and monthly usage periods are identified by dayPeriod
+// and monthPeriod, which use the bot's local time zone.
+const ALL_TIME_PERIOD = "all"
+
+var (
+    // The token usage of all requests to the AI.  This is replaced in main by a ledger that keeps
+    // the usage in the data directory, if there is one.
+    usageLedger = newUsageLedger()
+
+    // The models that have no price in the usage.prices setting, which have already been reported.
+    unpricedModels sync.Map
+)
+
+// A UsageRecord describes the tokens used by one request to the AI and what they cost.  Requests
+// made to summarize conversation history have no user, server, or channel.
+type UsageRecord struct {
+    Time      time.Time `json:"time"`
+    ConvKey   string    `json:"conv_key"`
+    UserID    string    `json:"user_id,omitempty"`
+    UserName  string    `json:"user_name,omitempty"`
+    GuildID   string    `json:"guild_id,omitempty"`
+    ChannelID string    `json:"channel_id,omitempty"`
+    Model     string    `json:"model"`
+
+    AIUsage
+
+    // The cost in US dollars, from the usage.prices setting at the time of the request.
+    Cost float64 `json:"cost"`
+}
+
+// A UsageTotals holds the total usage of a number of requests to the AI.
+type UsageTotals struct {
+    Requests int
+
+    AIUsage
+
+    // The total cost in US dollars.
+    Cost float64
+}
+
+// This method adds the usage of record to totals.
+func (totals *UsageTotals) add(record UsageRecord) {
+    totals.Requests++
+    totals.InputTokens += record.InputTokens
+    totals.OutputTokens += record.OutputTokens
+    totals.CacheCreationInputTokens += record.CacheCreationInputTokens
+    totals.CacheReadInputTokens += record.CacheReadInputTokens
+    totals.WebSearchRequests += record.WebSearchRequests
+    totals.Cost += record.Cost
+}
+
+// This method returns the total number of tokens in totals, including cached input tokens.
+func (totals UsageTotals) tokens() int {
+    return totals.InputTokens + totals.OutputTokens + totals.CacheCreationInputTokens + totals.CacheReadInputTokens
+}
+
+// A UserUsage holds the usage totals of one user for some period.
+type UserUsage struct {
+    UserID   string
+    UserName string
+    Totals   UsageTotals
+}
+
+// UsageLedger records the usage of every request to the AI and keeps running totals per period
+// (all time, each day, and each month) and per scope (everyone, each user, each channel, and each
+// server).  If it has a file, each record is appended to the file as one line of JSON, and the
+// totals are rebuilt from the file when the bot restarts.
+type UsageLedger struct {
+    // The path of the file holding the records, or the empty string if they aren't persisted.
+    path string
+
+    // The running totals, keyed by usageTotalsKey.
+    totals map[string]*UsageTotals
+
+    // The most recent name of each user, keyed by user ID.
+    userNames map[string]string
+
+    // Mutex protecting the above from concurrent access and serializing writes to the file.
+    mu sync.Mutex
+}
+
+// This function creates an empty UsageLedger that doesn't persist its records.
+func newUsageLedger() *UsageLedger {
+    return &UsageLedger{totals: make(map[string]*UsageTotals), userNames: make(map[string]string)}
+}
+
+// This function creates a UsageLedger that keeps its records in the file at path, and loads the
+// records that are already there.
+func openUsageLedger(path string) (*UsageLedger, error) {
+    ledger := newUsageLedger()
+    ledger.path = path
+
+    file, err := os.Open(path)
+
+    if os.IsNotExist(err) {
+        return ledger, nil
+    }
+
+    if err != nil {
+        return nil, fmt.Errorf("cannot open usage file: %v", err)
+    }
+
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+
+    for lineNumber := 1; scanner.Scan(); lineNumber++ {
+        var record UsageRecord
+
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+            // A partially written last line (e.g., after a crash) is skipped rather than making
+            // the whole file unreadable.
+            fmt.Printf("%v: openUsageLedger: Skipping bad line %v in %v: %v\n", Me, lineNumber, path, err)
+            continue
+        }
+
+        ledger.add(record)
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("cannot read usage file: %v", err)
+    }
+
+    return ledger, nil
+}
+
+// This method adds record to the ledger and, if the ledger has a file, appends it to the file.
+func (ledger *UsageLedger) Record(record UsageRecord) error {
+    ledger.mu.Lock()
+    defer ledger.mu.Unlock()
+
+    ledger.add(record)
+
+    if ledger.path == "" {
+        return nil
+    }
+
+    recordBytes, err := json.Marshal(record)
+
+    if err != nil {
+        return err
+    }
+
+    file, err := os.OpenFile(ledger.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+
+    if err != nil {
+        return err
+    }
+
+    _, err = file.Write(append(recordBytes, '\n'))
+
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+
+    return err
+}
+
+// This method writes the ledger's file (if it has one) to disk, so that the records appended so far
+// survive a crash of the machine.
+func (ledger *UsageLedger) Flush() error {
+    ledger.mu.Lock()
+    defer ledger.mu.Unlock()
+
+    if ledger.path == "" {
+        return nil
+    }
+
+    return syncFile(ledger.path)
+}
+
+// This method adds record to the running totals.  The caller must hold ledger.mu, or be the only
+// user of the ledger.
+func (ledger *UsageLedger) add(record UsageRecord) {
+    scopes := []string{"all", "user:" + record.UserID}
+
+    if record.ChannelID != "" {
+        scopes = append(scopes, "channel:"+record.ChannelID)
+    }
+
+    if record.GuildID != "" {
+        scopes = append(scopes, "guild:"+record.GuildID)
+    }
+
+    for _, period := range []string{ALL_TIME_PERIOD, dayPeriod(record.Time), monthPeriod(record.Time)} {
+        for _, scope := range scopes {
+            key := usageTotalsKey(period, scope)
+            totals := ledger.totals[key]
+
+            if totals == nil {
+                totals = &UsageTotals{}
+                ledger.totals[key] = totals
+            }
+
+            totals.add(record)
+        }
+    }
+
+    if record.UserID != "" && record.UserName != "" {
+        ledger.userNames[record.UserID] = record.UserName
+    }
+}
+
+// This method returns the usage totals for period (e.g., the value of dayPeriod) and scope, which is
+// "all" for everyone, or "user:ID", "channel:ID", or "guild:ID" for one user, channel, or server.
+func (ledger *UsageLedger) Totals(period string, scope string) UsageTotals {
+    ledger.mu.Lock()
+    defer ledger.mu.Unlock()
+
+    if totals := ledger.totals[usageTotalsKey(period, scope)]; totals != nil {
+        return *totals
+    }
+
+    return UsageTotals{}
+}
+
+// This method returns the usage totals of each user for period, most expensive first.  Requests
+// that have no user (i.e., summarization requests) are totaled under the user ID "".
+func (ledger *UsageLedger) UserTotals(period string) []UserUsage {
+    ledger.mu.Lock()
+    defer ledger.mu.Unlock()
+
+    prefix := usageTotalsKey(period, "user:")
+
+    var users []UserUsage
+
+    for key, totals := range ledger.totals {
+        if userID, ok := strings.CutPrefix(key, prefix); ok {
+            users = append(users, UserUsage{UserID: userID, UserName: ledger.userNames[userID], Totals: *totals})
+        }
+    }
+
+    sort.Slice(users, func(i, j int) bool {
+        if users[i].Totals.Cost != users[j].Totals.Cost {
+            return users[i].Totals.Cost > users[j].Totals.Cost
+        }
+
+        return users[i].Totals.tokens() > users[j].Totals.tokens()
+    })
+
+    return users
+}
+
+// This function returns the key of the running totals for period and scope in UsageLedger.totals.
+func usageTotalsKey(period string, scope string) string {
+    return period + " " + scope
+}
+
+// This function returns the daily usage period containing when.
+func dayPeriod(when time.Time) string {
+    return "day:" + when.Local().Format(time.DateOnly)
+}
+
+// This function returns the monthly usage period containing when.
+func monthPeriod(when time.Time) string {
+    return "month:" + when.Local().Format("2006-01")
+}
+
+// This function records the usage of response, which the AI generated for query (or, if query is
+// nil, to summarize the history of the conversation identified by convKey).  The cost is computed
+// from the usage.prices setting in cfg.
+func recordUsage(cfg *Config, query *Query, convKey string, response *AIResponse) {
+    record := UsageRecord{
+        Time:    time.Now(),
+        ConvKey: convKey,
+        Model:   response.Model,
+        AIUsage: response.Usage,
+        Cost:    usageCost(cfg, response.Model, response.Usage),
+    }
+
+    if query != nil {
+        record.UserID = query.UserID
+        record.UserName = query.Nick
+        record.GuildID = query.GuildID
+        record.ChannelID = query.ChannelID
+    }
+
+    if err := usageLedger.Record(record); err != nil {
+        fmt.Printf("%v: recordUsage: Error recording usage: %v\n", Me, err)
+    }
+}
+
+// This function returns the cost in US dollars of usage by model, using the prices in cfg.  If
+// model has no price, only the Web searches are charged for, and a warning is written to stdout
+// the first time that happens for model.
+func usageCost(cfg *Config, model string, usage AIUsage) float64 {
+    cost := float64(usage.WebSearchRequests) * cfg.Usage.WebSearchPrice / 1000
+    price, ok := cfg.Usage.Prices[model]
+
+    if !ok {
+        // Look for a price whose name is a prefix of model (e.g., "claude-sonnet-4" for
+        // "claude-sonnet-4-20250514").  The longest such name wins.
+        longestName := ""
+
+        for name, namePrice := range cfg.Usage.Prices {
+            if strings.HasPrefix(model, name) && len(name) > len(longestName) {
+                longestName, price, ok = name, namePrice, true
+            }
+        }
+    }
+
+    if !ok {
+        if _, warned := unpricedModels.LoadOrStore(model, true); !warned {
+            fmt.Printf("%v: usageCost: Model '%v' has no price in usage.prices, so its tokens cost nothing\n",
+                       Me, model)
+        }
+
+        return cost
+    }
+
+    return cost + (float64(usage.InputTokens) * price.Input +
+                   float64(usage.OutputTokens) * price.Output +
+                   float64(usage.CacheCreationInputTokens) * price.CacheWrite +
+                   float64(usage.CacheReadInputTokens) * price.CacheRead) / 1e6
+}
+
+// This function sends the usage requested by the '!usage' or '/usage' command with responder.
+// scope is "me" (the usage of the user identified by userID), "channel" (the usage in the channel
+// identified by channelID), "today", or "month" (everyone's usage today or this month).
+func sendUsageMessage(responder Responder, scope string, userID string, channelID string) {
+    now := time.Now()
+
+    periodLines := func(scope string) string {
+        return fmt.Sprintf("• Today: %v\n• This month: %v\n• All time: %v",
+                           formatUsageTotals(usageLedger.Totals(dayPeriod(now), scope)),
+                           formatUsageTotals(usageLedger.Totals(monthPeriod(now), scope)),
+                           formatUsageTotals(usageLedger.Totals(ALL_TIME_PERIOD, scope)))
+    }
+
+    var msg string
+
+    switch scope {
+    case "", "me":
+        msg = fmt.Sprintf("Usage by <@%v>:\n", userID) + periodLines("user:"+userID)
+    case "channel":
+        msg = fmt.Sprintf("Usage in <#%v>:\n", channelID) + periodLines("channel:"+channelID)
+    case "today":
+        msg = "Usage by everyone today: " + formatUsageTotals(usageLedger.Totals(dayPeriod(now), "all"))
+    case "month":
+        msg = "Usage by everyone this month: " + formatUsageTotals(usageLedger.Totals(monthPeriod(now), "all"))
+    default:
+        msg = fmt.Sprintf("Sorry, I don't know the usage scope '%v'.  Use 'me', 'channel', 'today', or 'month'.",
+                          scope)
+    }
+
+    sendLongMessage(responder, msg)
+}
+
+// This function sends the usage of each user during period ("today", "month", or "all") with
+// responder.
+func sendUsageBreakdownMessage(responder Responder, period string) {
+    now := time.Now()
+
+    var usagePeriod, periodName string
+
+    switch period {
+    case "today":
+        usagePeriod, periodName = dayPeriod(now), "today"
+    case "", "month":
+        usagePeriod, periodName = monthPeriod(now), "this month"
+    case "all":
+        usagePeriod, periodName = ALL_TIME_PERIOD, "of all time"
+    default:
+        responder.Send(fmt.Sprintf("Sorry, I don't know the usage period '%v'.  Use 'today', 'month', or 'all'.",
+                                   period))
+        return
+    }
+
+    users := usageLedger.UserTotals(usagePeriod)
+
+    if len(users) == 0 {
+        responder.Send("Nobody has used the AI " + periodName + ".")
+        return
+    }
+
+    var msg strings.Builder
+
+    msg.WriteString(fmt.Sprintf("Usage by user %v (total: %v):", periodName,
+                                formatUsageTotals(usageLedger.Totals(usagePeriod, "all"))))
+
+    for index, user := range users {
+        var name string
+
+        switch {
+        case user.UserID == "":
+            name = "Conversation summaries"
+        case user.UserName != "":
+            // Don't mention the users, which would notify them.
+            name = user.UserName
+        default:
+            name = "User " + user.UserID
+        }
+
+        msg.WriteString(fmt.Sprintf("\n%v. %v: %v", index+1, name, formatUsageTotals(user.Totals)))
+    }
+
+    sendLongMessage(responder, msg.String())
+}
+
+// This function formats totals for people to read.
+func formatUsageTotals(totals UsageTotals) string {
+    if totals.Requests == 0 {
+        return "nothing"
+    }
+
+    text := fmt.Sprintf("%v %v, %v tokens (%v in, %v out", formatCount(totals.Requests),
+                        plural(totals.Requests, "request", "requests"), formatCount(totals.tokens()),
+                        formatCount(totals.InputTokens+totals.CacheCreationInputTokens+totals.CacheReadInputTokens),
+                        formatCount(totals.OutputTokens))
+
+    if cached := totals.CacheReadInputTokens; cached > 0 {
+        text += fmt.Sprintf(", %v cached", formatCount(cached))
+    }
+
+    text += ")"
+
+    if searches := totals.WebSearchRequests; searches > 0 {
+        text += fmt.Sprintf(", %v %v", formatCount(searches), plural(searches, "Web search", "Web searches"))
+    }
+
+    return text + ", " + formatDollars(totals.Cost)
+}
+
+// This function formats count with commas between groups of three digits (e.g., "12,345").
+func formatCount(count int) string {
+    if count < 0 {
+        return "-" + formatCount(-count)
+    }
+
+    digits := fmt.Sprint(count)
+
+    for index := len(digits) - 3; index > 0; index -= 3 {
+        digits = digits[:index] + "," + digits[index:]
+    }
+
+    return digits
+}
+
+// This function formats an amount of US dollars.  Small amounts get more decimal places, so that
+// they don't all look like $0.00.
+func formatDollars(dollars float64) string {
+    if dollars < 1 {
+        return fmt.Sprintf("$%.4f", dollars)
+    }
+
+    return fmt.Sprintf("$%.2f", dollars)
+}
+
+// This function returns singular if count is 1, otherwise plural.
+func plural(count int, singular string, plural string) string {
+    if count == 1 {
+        return singular
+    }
+
+    return plural
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "math"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// This test checks that usageCost prices a model by its exact name if it has a price, otherwise by
+// the longest name in usage.prices that's a prefix of its name, and charges only for Web searches
+// if neither exists.
+func TestUsageCost(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.Usage.WebSearchPrice = 10
+    cfg.Usage.Prices = map[string]ModelPrice{
+        "claude":                   {Input: 1, Output: 1},
+        "claude-sonnet-4":          {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.30},
+        "claude-sonnet-4-20250514": {Input: 2, Output: 10},
+    }
+
+    usage := AIUsage{InputTokens: 1_000_000, OutputTokens: 100_000, CacheCreationInputTokens: 200_000,
+                     CacheReadInputTokens: 500_000, WebSearchRequests: 3}
+
+    testCases := []struct {
+        model    string
+        expected float64
+    }{
+        // An exact match wins over the prefixes.
+        {"claude-sonnet-4-20250514", 2 + 1 + 0.03},
+        // The longest prefix wins.
+        {"claude-sonnet-4-5", 3 + 1.5 + 0.75 + 0.15 + 0.03},
+        {"claude-opus-4", 1 + 0.1 + 0.03},
+        // No price, so only the Web searches cost anything.
+        {"gpt-4o", 0.03},
+    }
+
+    for _, testCase := range testCases {
+        if cost := usageCost(cfg, testCase.model, usage); math.Abs(cost-testCase.expected) > 1e-9 {
+            t.Errorf("usageCost(%q) = %v, expected %v", testCase.model, cost, testCase.expected)
+        }
+    }
+}
+
+// This test records usage in a ledger with a file, and checks that opening the file again rebuilds
+// the same totals, skipping a partially written last line.
+func TestUsageLedgerReload(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "usage.jsonl")
+    ledger, err := openUsageLedger(path)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    march := time.Date(2026, 3, 31, 12, 0, 0, 0, time.Local)
+    april := time.Date(2026, 4, 1, 12, 0, 0, 0, time.Local)
+
+    records := []UsageRecord{
+        {Time: march, UserID: "alice", UserName: "Alice", GuildID: "g", ChannelID: "c1", Model: "m",
+         AIUsage: AIUsage{InputTokens: 100, OutputTokens: 10}, Cost: 0.5},
+        {Time: april, UserID: "alice", UserName: "Alice", GuildID: "g", ChannelID: "c2", Model: "m",
+         AIUsage: AIUsage{InputTokens: 200, OutputTokens: 20, CacheReadInputTokens: 50}, Cost: 0.25},
+        {Time: april, UserID: "bob", UserName: "Bob", ChannelID: "dm", Model: "m",
+         AIUsage: AIUsage{InputTokens: 300, OutputTokens: 30, WebSearchRequests: 1}, Cost: 1},
+        {Time: april, ConvKey: "ch:c1", Model: "m", AIUsage: AIUsage{InputTokens: 40, OutputTokens: 4}, Cost: 0.125},
+    }
+
+    for _, record := range records {
+        if err := ledger.Record(record); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Simulate a crash in the middle of writing a record.
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    file.WriteString(`{"time":"2026-04-01T12:00:00Z","user_id":"alice","input_tok`)
+    file.Close()
+
+    reloaded, err := openUsageLedger(path)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    queries := []struct {
+        period string
+        scope  string
+    }{
+        {ALL_TIME_PERIOD, "all"},
+        {ALL_TIME_PERIOD, "user:alice"},
+        {ALL_TIME_PERIOD, "user:"},
+        {monthPeriod(march), "user:alice"},
+        {monthPeriod(april), "all"},
+        {dayPeriod(april), "user:bob"},
+        {dayPeriod(april), "channel:c2"},
+        {monthPeriod(march), "guild:g"},
+        {ALL_TIME_PERIOD, "guild:g"},
+    }
+
+    for _, query := range queries {
+        original := ledger.Totals(query.period, query.scope)
+
+        if original.Requests == 0 {
+            t.Errorf("%v %v: no requests recorded", query.period, query.scope)
+        }
+
+        if totals := reloaded.Totals(query.period, query.scope); totals != original {
+            t.Errorf("%v %v: reloaded totals %+v, expected %+v", query.period, query.scope, totals, original)
+        }
+    }
+
+    if all := reloaded.Totals(ALL_TIME_PERIOD, "all"); all.Requests != 4 || all.tokens() != 754 || all.Cost != 1.875 {
+        t.Errorf("reloaded all-time totals %+v, expected 4 requests, 754 tokens, and $1.875", all)
+    }
+
+    users := reloaded.UserTotals(ALL_TIME_PERIOD)
+
+    if len(users) != 3 || users[0].UserName != "Bob" || users[1].UserName != "Alice" || users[2].UserID != "" {
+        t.Errorf("reloaded user totals %+v, expected Bob, Alice, and the summaries, in that order", users)
+    }
+}